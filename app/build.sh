@@ -4,13 +4,17 @@ GOPATH=`pwd` \
       github.com/zenazn/goji \
       github.com/zenazn/goji/web \
       github.com/zenazn/goji/web/middleware \
-      github.com/goji/httpauth \
+      golang.org/x/crypto/bcrypt \
       gopkg.in/yaml.v2 \
       github.com/ActiveState/tail \
       github.com/jinzhu/gorm \
       github.com/mattn/go-sqlite3 \
       github.com/robfig/cron \
+      github.com/prometheus/client_golang/prometheus \
+      github.com/prometheus/client_golang/prometheus/promhttp \
+      github.com/fsnotify/fsnotify \
     || exit -1
 
 echo "building..."
 GOPATH=`pwd` go build -o bin/server server || exit -2
+GOPATH=`pwd` go build -o bin/subako cli || exit -2
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"subako"
+
+	"os"
+	"log"
+	"fmt"
+	"flag"
+	"errors"
+	"time"
+)
+
+
+func backup(cwd string, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	aptMetadataOnly := flags.Bool("apt-metadata-only", false, "do not include package files of the apt repository")
+	output := flags.String("o", fmt.Sprintf("subako-backup-%s.tar.gz", time.Now().Format("20060102-150405")), "output file")
+	flags.Parse(args)
+
+	uConfig, err := loadUserConfig(cwd)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*output, os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	manifest, err := subako.CreateBackup(f, subako.StorageDir(cwd), &subako.BackupOptions{
+		AptMetadataOnly: *aptMetadataOnly,
+		ConfigSetsDir: uConfig.ConfigSetsDir(cwd),
+	})
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	log.Printf("Backup => %s (%d files, config revision: %s)", *output, len(manifest.Files), manifest.ConfigRevision)
+
+	return nil
+}
+
+// the server must be stopped while restoring
+func restore(cwd string, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: subako restore FILE")
+	}
+
+	uConfig, err := loadUserConfig(cwd)
+	if err != nil {
+		return err
+	}
+
+	manifest, oldDir, err := subako.RestoreBackup(flags.Arg(0), subako.StorageDir(cwd))
+	if err != nil {
+		if oldDir != "" {
+			log.Printf("Replaced files are in %s", oldDir)
+		}
+		return err
+	}
+
+	log.Printf("Restored the backup created at %v (config revision: %s)", manifest.CreatedAt, manifest.ConfigRevision)
+	log.Printf("Replaced files are moved to %s", oldDir)
+	if revision := subako.ConfigRevision(uConfig.ConfigSetsDir(cwd)); revision != manifest.ConfigRevision {
+		log.Printf("NOTE: the revision of config sets is different from the backup (current: %s)", revision)
+	}
+	if manifest.AptMetadataOnly {
+		log.Printf("NOTE: the backup has only metadata of the apt repository, package files must be copied to the pool")
+	}
+
+	return nil
+}
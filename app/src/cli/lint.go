@@ -0,0 +1,41 @@
+package main
+
+import (
+	"subako"
+
+	"os"
+	"log"
+	"fmt"
+	"flag"
+	"errors"
+	"io/ioutil"
+)
+
+
+// lint checks config sets offline. It exits with nonzero status when there are problems.
+func lint(cwd string, args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "show logs of loading")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: subako lint DIR")
+	}
+
+	if !*verbose {
+		// restored for the error which is reported by main
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	errs := subako.LintConfigSets(flags.Arg(0))
+	for _, e := range errs {
+		fmt.Println(e.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d problem(s) are found", len(errs))
+	}
+
+	fmt.Println("OK")
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"subako"
+
+	"os"
+	"log"
+	"fmt"
+	"path"
+	"sort"
+)
+
+
+type command struct {
+	usage		string
+	run			func(cwd string, args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {"backup [-apt-metadata-only] [-o FILE]", backup},
+	"restore": {"restore FILE", restore},
+	"lint": {"lint DIR", lint},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: subako COMMAND [ARGS]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name, _ := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+// run in the directory which has config.yml (same as the server)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cmd.run(cwd, os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadUserConfig(cwd string) (*subako.UserConfig, error) {
+	return subako.LoadUserConfig(path.Join(cwd, "config.yml"))
+}
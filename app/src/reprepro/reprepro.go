@@ -1,7 +1,14 @@
 package reprepro
 
+import (
+	"strings"
+)
+
 const ExecName = "reprepro"
 
+// retry count (every 10 seconds) while the repository is locked by others (Ex. subako backup)
+const waitForLockCount = "30"
+
 type Reprepro struct {
 	RepositoryPath	string
 	CodeName		string
@@ -9,21 +16,30 @@ type Reprepro struct {
 
 func (r *Reprepro) MakeAddCommand(packagePath string) []string {
 	args := r.makeIncludePart(packagePath)
-	return append([]string{"reprepro", "-b", r.RepositoryPath}, args...)
+	return append(r.makeBasePart(), args...)
 }
 
-func (r *Reprepro) MakeLsCommand(packagePath string) []string {
+// MakeLsCommand lists all packages of the code name (see ParseListOutput)
+func (r *Reprepro) MakeLsCommand() []string {
 	args := r.makeListPart()
-	return append([]string{"reprepro", "-b", r.RepositoryPath}, args...)
+	return append(r.makeBasePart(), args...)
+}
+
+func (r *Reprepro) MakeVersionCommand() []string {
+	return []string{"reprepro", "--version"}
 }
 
 func (r *Reprepro) MakeRemoveCommand(packageName string) []string {
 	args := r.makeRemovePart(packageName)
-	return append([]string{"reprepro", "-b", r.RepositoryPath}, args...)
+	return append(r.makeBasePart(), args...)
 	// "deleteunreferenced"
 }
 
 
+func (r *Reprepro) makeBasePart() []string {
+	return []string{"reprepro", "--waitforlock=" + waitForLockCount, "-b", r.RepositoryPath}
+}
+
 func (r *Reprepro) makeIncludePart(packagePath string) []string {
 	return []string{"includedeb", r.CodeName, packagePath}
 }
@@ -32,6 +48,34 @@ func (r *Reprepro) makeListPart() []string {
 	return []string{"list", r.CodeName}
 }
 
+// ListEntry is a line of the output of the list command (Ex. "trusty|main|amd64: name 1.0")
+type ListEntry struct {
+	Name		string
+	Version		string
+	Component	string		// Ex. trusty|main|amd64
+}
+
+func ParseListOutput(out string) []ListEntry {
+	entries := make([]ListEntry, 0)
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+2:])
+		if len(fields) < 2 {
+			continue
+		}
+		entries = append(entries, ListEntry{
+			Name: fields[0],
+			Version: fields[1],
+			Component: line[:i],
+		})
+	}
+
+	return entries
+}
+
 func (r *Reprepro) makeRemovePart(packageName string) []string {
 	return []string{"remove", r.CodeName, packageName}
 }
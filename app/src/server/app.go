@@ -6,24 +6,26 @@ import (
 	"flag"
 	"os"
 	"log"
-	"path/filepath"
 	"net/http"
+	"net/url"
 	"io/ioutil"
 
 	"github.com/zenazn/goji"
 	"github.com/zenazn/goji/web"
-	"github.com/goji/httpauth"
+	"github.com/zenazn/goji/graceful"
 
 	"github.com/flosch/pongo2"
 	"github.com/ActiveState/tail"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"strconv"
 	"encoding/json"
-	"gopkg.in/yaml.v2"
 
 	"time"
 	"path"
 	"fmt"
+	"strings"
+	"syscall"
 
 	"crypto/hmac"
 	"crypto/sha1"
@@ -33,34 +35,6 @@ import (
 var gSubakoCtx *subako.SubakoContext
 const packageConfigsHookName = "__configs"
 
-type userConfig struct {
-	Server			struct {
-		Port		int
-	}
-	Notification	struct {
-		Url			string
-		Secret		string
-	}
-	Cron			struct {
-		Hour		int
-		Minute		int
-	}
-	Auth			struct {
-		User		string
-		Password	string
-	}
-	Builder			*struct {
-		PackagePrefix		string	`yaml:"package_prefix"`
-		InstallBasePrefix	string	`yaml:"install_base_prefix"`
-	}
-	ConfigSets		struct {
-		Remote		bool
-		Path		string
-		Repository	string
-		RepoSecret	string	`yaml:"webhook_secret"`
-	} `yaml:"config_sets"`
-}
-
 func main() {
 	defer func() {
 		log.Println("Exit main")
@@ -72,12 +46,8 @@ func main() {
 	}
 
 	// read user config
-	buffer, err := ioutil.ReadFile(path.Join(cwd, "config.yml"),)
-    if err != nil {
-		log.Fatal(err)
-    }
-	var uConfig userConfig
-	if err := yaml.Unmarshal(buffer, &uConfig); err != nil {
+	uConfig, err := subako.LoadUserConfig(path.Join(cwd, "config.yml"))
+	if err != nil {
 		log.Fatal(err)
 	}
 
@@ -87,9 +57,6 @@ func main() {
 	log.Printf("Cron Timing: %d:%d", uConfig.Cron.Hour, uConfig.Cron.Minute)
 	log.Printf("ConfigSets IsRemote: %v", uConfig.ConfigSets.Remote)
 	log.Printf("ConfigSets Path: %s", uConfig.ConfigSets.Path)
-	if uConfig.Builder == nil {
-		log.Fatal("builder section is not written in config")
-	}
 	log.Printf("PackagePrefix: %s", uConfig.Builder.PackagePrefix)
 	log.Printf("InstallPrefix: %s", uConfig.Builder.InstallBasePrefix)
 	if uConfig.ConfigSets.Remote {
@@ -100,52 +67,10 @@ func main() {
 	// port
 	flag.Set("bind", fmt.Sprintf(":%d", uConfig.Server.Port))
 
-	// make storage dir
-	storageDir := path.Join(cwd, "_storage")
-	if !subako.Exists(storageDir) {
-		if err := os.Mkdir(storageDir, 0755); err != nil {
-			log.Fatal(err)
-		}
-	}
-
 	// make config
-	config := &subako.SubakoConfig{
-		ProcConfigSetsConf: func() *subako.ProcConfigSetsConfig{
-			path := func() string {
-				if filepath.IsAbs(uConfig.ConfigSets.Path) {
-					return uConfig.ConfigSets.Path
-				} else {
-					return path.Join(cwd, uConfig.ConfigSets.Path)
-				}
-			}()
-
-			return &subako.ProcConfigSetsConfig{
-				IsRemote: uConfig.ConfigSets.Remote,
-				BaseDir: path,
-				Repository: uConfig.ConfigSets.Repository,
-			}
-		}(),
-		AvailablePackagesPath: path.Join(storageDir, "available_packages.json"),
-		AptRepositoryBaseDir: path.Join(storageDir, "apt_repository"),
-
-		VirtualUsrDir: path.Join(storageDir, "torigoya_usr"),
-		TmpBaseDir: path.Join(storageDir, "temp"),
-		PackagesDir: path.Join(storageDir, "packages"),
-		PackagePrefix: uConfig.Builder.PackagePrefix,
-		InstallBasePrefix: uConfig.Builder.InstallBasePrefix,
-
-		RunningTasksPath: path.Join(storageDir, "running_tasks.json"),
-		ProfilesHolderPath: path.Join(storageDir, "proc_profiles.json"),
-		DataBasePath: path.Join(storageDir, "db.sqlite"),
-		NotificationConf: &subako.NotificationConfig{
-			TargetUrl: uConfig.Notification.Url,
-			Secret: uConfig.Notification.Secret,
-		},
-		CronData: subako.Crontab {
-			Hour: uConfig.Cron.Hour,
-			Minute: uConfig.Cron.Minute,
-		},
-		LogDir: "/tmp",
+	config, err := uConfig.MakeSubakoConfig(cwd)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	subakoCtx, err := subako.MakeSubakoContext(config)
@@ -153,7 +78,9 @@ func main() {
 		panic(err)
 	}
 	defer func() {
-		if err := subakoCtx.Save(); err != nil {
+		// goji.Serve returns after the signal has been handled
+		wait := time.Duration(uConfig.Shutdown.WaitRunningBuildsSec) * time.Second
+		if err := subakoCtx.Shutdown(wait); err != nil {
 			panic(err)
 		}
 	}()
@@ -181,14 +108,15 @@ func main() {
 	//
 	gSubakoCtx = subakoCtx
 
+	// create the initial admin from the auth section
+	if err := subakoCtx.Users.EnsureAdmin(uConfig.Auth.User, uConfig.Auth.Password); err != nil {
+		panic(err)
+	}
+
 	//
-	authOpts := httpauth.AuthOptions{
-        Realm: "TorigoyaFactory",
-        User: uConfig.Auth.User,
-        Password: uConfig.Auth.Password,
-    }
+	goji.Use(authenticate)
 	reqAuthMux := web.New()
-	reqAuthMux.Use(httpauth.BasicAuth(authOpts))
+	reqAuthMux.Use(requireLogin)
 
 	//
 	pongo2.DefaultSet.SetBaseDirectory("views")
@@ -197,42 +125,84 @@ func main() {
 	goji.Get("/apt/*", http.StripPrefix("/apt/", http.FileServer(http.Dir(subakoCtx.AptRepoCtx.AptRepositoryBaseDir))))
 
 	goji.Get("/", index)
+	reqAuthMux.Get("/login", login)
 
 	reqAuthMux.Get("/live_status/:id", liveStatus)
-	reqAuthMux.Get("/abort_task/:id", abortTask)
+	reqAuthMux.Get("/abort_task/:id", requireRole(subako.RoleBuilder, abortTask))
 	goji.Get("/status/:id", status)
 
-	reqAuthMux.Get("/build/:name/:version", build)
-	reqAuthMux.Get("/queue/:name/:version", queue)
+	reqAuthMux.Get("/build/:name/:version", requireRole(subako.RoleBuilder, build))
+	reqAuthMux.Get("/queue/:name/:version", requireRole(subako.RoleBuilder, queue))
 
-	reqAuthMux.Get("/build/:name/:version/:dep_name/:dep_version", buildDep)
-	reqAuthMux.Get("/queue/:name/:version/:dep_name/:dep_version", queueDep)
+	reqAuthMux.Get("/build/:name/:version/:dep_name/:dep_version", requireRole(subako.RoleBuilder, buildDep))
+	reqAuthMux.Get("/queue/:name/:version/:dep_name/:dep_version", requireRole(subako.RoleBuilder, queueDep))
+	reqAuthMux.Get("/build_deps/:name/:version", requireRole(subako.RoleBuilder, buildDep))	// ?deps=name/version,...
+	reqAuthMux.Get("/queue_deps/:name/:version", requireRole(subako.RoleBuilder, queueDep))
+	reqAuthMux.Get("/matrix/:name", showBuildMatrix)
+	reqAuthMux.Post("/matrix/:name/queue", requireRole(subako.RoleBuilder, queueBuildMatrix))
 
 	goji.Get("/packages", showPackages)
-	reqAuthMux.Get("/remove_package/:name/:version", removePackage)
-	reqAuthMux.Get("/remove_package/:name/:version/:dep_name/:dep_version", removePackageDep)
-
-	reqAuthMux.Get("/webhooks", webhooks)
-	reqAuthMux.Post("/webhooks/append", webhooksAppend)
-	reqAuthMux.Post("/webhooks/update/:id", webhooksUpdate)
-	reqAuthMux.Post("/webhooks/delete/:id", webhooksDelete)
+	reqAuthMux.Get("/remove_package/:name/:version", requireRole(subako.RoleAdmin, removePackageDep))
+	reqAuthMux.Get("/remove_package/:name/:version/:dep_name/:dep_version", requireRole(subako.RoleAdmin, removePackageDep))
+	reqAuthMux.Get("/remove_package_deps/:name/:version", requireRole(subako.RoleAdmin, removePackageDep))
+	reqAuthMux.Post("/remove_package_deps/:name/:version", requireRole(subako.RoleAdmin, removePackageDep))	// with mode (only POST)
+	reqAuthMux.Post("/orphans/check", requireRole(subako.RoleAdmin, checkOrphans))
+	reqAuthMux.Get("/reconcile", requireRole(subako.RoleAdmin, showReconcile))
+	reqAuthMux.Post("/reconcile/repair", requireRole(subako.RoleAdmin, repairReconcile))	// with direction
+
+	reqAuthMux.Get("/webhooks", requireRole(subako.RoleAdmin, webhooks))
+	reqAuthMux.Post("/webhooks/append", requireRole(subako.RoleAdmin, webhooksAppend))
+	reqAuthMux.Post("/webhooks/update/:id", requireRole(subako.RoleAdmin, webhooksUpdate))
+	reqAuthMux.Post("/webhooks/delete/:id", requireRole(subako.RoleAdmin, webhooksDelete))
 	goji.Post("/webhooks/fire/:name", webhookEvent)
 
 	reqAuthMux.Get("/daily_tasks", dailyTasks)
-	reqAuthMux.Post("/daily_tasks/append", dailyTasksAppend)
-	reqAuthMux.Post("/daily_tasks/update/:id", dailyTasksUpdate)
-	reqAuthMux.Post("/daily_tasks/delete/:id", dailyTasksDelete)
+	reqAuthMux.Post("/daily_tasks/append", requireRole(subako.RoleAdmin, dailyTasksAppend))
+	reqAuthMux.Post("/daily_tasks/update/:id", requireRole(subako.RoleAdmin, dailyTasksUpdate))
+	reqAuthMux.Post("/daily_tasks/delete/:id", requireRole(subako.RoleAdmin, dailyTasksDelete))
 
-	reqAuthMux.Get("/update_proc_config_sets", updateProcConfigSets)
-	reqAuthMux.Get("/regenerate_profiles", regenerateProfiles)
+	reqAuthMux.Get("/update_proc_config_sets", requireRole(subako.RoleAdmin, updateProcConfigSets))
+	reqAuthMux.Post("/config_sets/ref", requireRole(subako.RoleAdmin, switchConfigSetsRef))
+	reqAuthMux.Get("/regenerate_profiles", requireRole(subako.RoleAdmin, regenerateProfiles))
 
 	reqAuthMux.Get("/system_logs", showMiniLogs)
+	reqAuthMux.Get("/audit_logs", requireRole(subako.RoleAdmin, showAuditLogs))
+	reqAuthMux.Get("/audit_logs/export", requireRole(subako.RoleAdmin, exportAuditLogs))
+
+	reqAuthMux.Get("/users", requireRole(subako.RoleAdmin, users))
+	reqAuthMux.Post("/users/append", requireRole(subako.RoleAdmin, usersAppend))
+	reqAuthMux.Post("/users/update/:id", requireRole(subako.RoleAdmin, usersUpdate))
+	reqAuthMux.Post("/users/delete/:id", requireRole(subako.RoleAdmin, usersDelete))
+
+	reqAuthMux.Get("/api_tokens", requirePassword(apiTokens))
+	reqAuthMux.Post("/api_tokens/create", requirePassword(apiTokensCreate))
+	reqAuthMux.Post("/api_tokens/revoke/:id", requirePassword(apiTokensRevoke))
 
 	goji.Get("/information", showInfo)
 
 	goji.Get("/api/profiles", showProfilesAPI)
+	goji.Get("/api/profile_aliases", showProfileAliasesAPI)
+	goji.Get("/api/config_errors", showConfigErrorsAPI)
+	goji.Get("/config_history", showConfigHistory)
+	goji.Get("/api/config_history", showConfigHistoryAPI)
+	goji.Get("/schemas", showSchemas)
+	goji.Get("/schemas/:name", showSchema)
+	goji.Get("/healthz", healthz)
+	goji.Get("/readyz", readyz)
+	goji.Get("/metrics", promhttp.HandlerFor(subakoCtx.Metrics.Registry, promhttp.HandlerOpts{}))
+	reqAuthMux.Get("/api/tasks", showTasksAPI)
+	reqAuthMux.Get("/api/matrix/:name", showBuildMatrixAPI)
+	reqAuthMux.Get("/api/orphans", showOrphansAPI)
+	reqAuthMux.Get("/api/reconcile", requireRole(subako.RoleAdmin, showReconcileAPI))
+	reqAuthMux.Post("/api/reconcile/repair", requireRole(subako.RoleAdmin, repairReconcile))
 	goji.Handle("/*", reqAuthMux)
 
+	// SIGINT is handled by goji by default
+	graceful.AddSignal(syscall.SIGTERM)
+	graceful.PreHook(func() {
+		subakoCtx.StopAccepting()
+	})
+
 	goji.Serve()
 }
 
@@ -246,11 +216,17 @@ func index(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	tasksForDisplay := gSubakoCtx.RunningTasks.MakeDisplayTask()
 
-	tpl.ExecuteWriter(pongo2.Context{
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
 		"config_sets_ctx": gSubakoCtx.ProcConfigSetsCtx,
+		"config_errors": gSubakoCtx.ProcConfigSetsCtx.ConfigErrors(),
 		"tasks": tasksForDisplay,
 		"queued_tasks": gSubakoCtx.QueueHelper,
-	}, w)
+	}), w)
+}
+
+// login forces the browser to send credentials, then goes back to the top page
+func login(c web.C, w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func liveStatus(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -340,10 +316,10 @@ func status(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	tpl.ExecuteWriter(pongo2.Context{
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
 		"task": runningTask,
 		"buffer": string(buffer),
-	}, w)
+	}), w)
 }
 
 func abortTask(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -365,6 +341,9 @@ func abortTask(c web.C, w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to kill container", http.StatusInternalServerError)
 			return
 		}
+		gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditAbort, "task", c.URLParams["id"], nil, map[string]string{
+			"log_name": runningTask.LogName,
+		})
 
 		// succeeded
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -390,7 +369,14 @@ func build(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	runningTask := gSubakoCtx.BuildAsync(procConfig)
+	runningTask, err := gSubakoCtx.BuildAsync(procConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditBuild, "package", subako.BuildConfigTargetID(procConfig), nil, map[string]int{
+		"task_id": runningTask.Id,
+	})
 
 	url := fmt.Sprintf("/live_status/%d", runningTask.Id)
 	http.Redirect(w, r, url, http.StatusSeeOther)
@@ -413,27 +399,42 @@ func queue(c web.C, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to add the task to queue", http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditQueue, "package", subako.BuildConfigTargetID(procConfig), nil, nil)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 
+// depKeyOf returns the dep key from /:dep_name/:dep_version (one dependency) or ?deps=name/version,...
+func depKeyOf(c web.C, r *http.Request) string {
+	if depName, ok := c.URLParams["dep_name"]; ok {
+		return subako.DepTuple{{
+			Name: subako.PackageName(depName),
+			Version: subako.PackageVersion(c.URLParams["dep_version"]),
+		}}.Key()
+	}
+
+	return r.URL.Query().Get("deps")
+}
+
 func buildDep(c web.C, w http.ResponseWriter, r *http.Request) {
 	log.Printf("build name => %s\n", c.URLParams["name"])
 	log.Printf("build version => %s\n", c.URLParams["version"])
-	log.Printf("build dep name => %s\n", c.URLParams["dep_name"])
-	log.Printf("build dep version => %s\n", c.URLParams["dep_version"])
+	depKey := depKeyOf(c, r)
+	log.Printf("build deps => %s\n", depKey)
 
 	name := c.URLParams["name"]
 	version := c.URLParams["version"]
-	depName := c.URLParams["dep_name"]
-	depVersion := c.URLParams["dep_version"]
 
-	procConfig, err := gSubakoCtx.ProcConfigSetsCtx.FindWithDep(
+	deps, err := subako.ParseDepKey(depKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	procConfig, err := gSubakoCtx.ProcConfigSetsCtx.FindWithDeps(
 		name,
 		version,
-		depName,
-		depVersion,
+		deps,
 		gSubakoCtx.AvailablePackages,
 	)
 	if err != nil {
@@ -441,7 +442,14 @@ func buildDep(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	runningTask := gSubakoCtx.BuildAsync(procConfig)
+	runningTask, err := gSubakoCtx.BuildAsync(procConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditBuild, "package", subako.BuildConfigTargetID(procConfig), nil, map[string]int{
+		"task_id": runningTask.Id,
+	})
 
 	url := fmt.Sprintf("/live_status/%d", runningTask.Id)
 	http.Redirect(w, r, url, http.StatusSeeOther)
@@ -450,19 +458,21 @@ func buildDep(c web.C, w http.ResponseWriter, r *http.Request) {
 func queueDep(c web.C, w http.ResponseWriter, r *http.Request) {
 	log.Printf("build name => %s\n", c.URLParams["name"])
 	log.Printf("build version => %s\n", c.URLParams["version"])
-	log.Printf("build dep name => %s\n", c.URLParams["dep_name"])
-	log.Printf("build dep version => %s\n", c.URLParams["dep_version"])
+	depKey := depKeyOf(c, r)
+	log.Printf("build deps => %s\n", depKey)
 
 	name := c.URLParams["name"]
 	version := c.URLParams["version"]
-	depName := c.URLParams["dep_name"]
-	depVersion := c.URLParams["dep_version"]
 
-	procConfig, err := gSubakoCtx.ProcConfigSetsCtx.FindWithDep(
+	deps, err := subako.ParseDepKey(depKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	procConfig, err := gSubakoCtx.ProcConfigSetsCtx.FindWithDeps(
 		name,
 		version,
-		depName,
-		depVersion,
+		deps,
 		gSubakoCtx.AvailablePackages,
 	)
 	if err != nil {
@@ -474,11 +484,75 @@ func queueDep(c web.C, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to add the task to queue", http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditQueue, "package", subako.BuildConfigTargetID(procConfig), nil, nil)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 
+func showBuildMatrix(c web.C, w http.ResponseWriter, r *http.Request) {
+	m, err := gSubakoCtx.MakeBuildMatrix(c.URLParams["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	tpl, err := pongo2.DefaultSet.FromFile("matrix.html")
+	if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
+		"matrix": m,
+	}), w)
+}
+
+func showBuildMatrixAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	m, err := gSubakoCtx.MakeBuildMatrix(c.URLParams["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(m)
+}
+
+// queue cells which are selected by "versions" and "deps" (all if empty). Built cells are queued only if "force" is set.
+func queueBuildMatrix(c web.C, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := &subako.BuildMatrixFilter{
+		DepKeys: r.Form["deps"],
+		Force: r.FormValue("force") != "",
+	}
+	for _, v := range r.Form["versions"] {
+		filter.Versions = append(filter.Versions, subako.PackageVersion(v))
+	}
+
+	name := c.URLParams["name"]
+	result, err := gSubakoCtx.QueueBuildMatrix(name, filter)
+	if result != nil {
+		actor := actorOf(c, r)
+		for _, target := range result.Queued {
+			gSubakoCtx.Audit.Record(actor, subako.AuditQueue, "package", target, nil, nil)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/matrix/" + url.QueryEscape(name), http.StatusSeeOther)
+}
+
+
 func showPackages(c web.C, w http.ResponseWriter, r *http.Request) {
 	tpl, err := pongo2.DefaultSet.FromFile("packages.html")
 	if err != nil {
@@ -486,20 +560,84 @@ func showPackages(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	tpl.ExecuteWriter(pongo2.Context{
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
 		"last_update": time.Unix(gSubakoCtx.AvailablePackages.LastUpdated, 0).String(),
 		"packages": gSubakoCtx.AvailablePackages,
-	}, w)
+		"orphan_report": gSubakoCtx.LastOrphanReport(),
+	}), w)
 }
 
-func removePackage(c web.C, w http.ResponseWriter, r *http.Request) {
+// removePackageDep shows packages which were built with the package before removing it.
+// It is removed by the mode in the form (refuse, cascade or orphan).
+// The mode is only accepted by POST, so that links cannot remove several packages.
+func removePackageDep(c web.C, w http.ResponseWriter, r *http.Request) {
 	log.Printf("rm name => %s\n", c.URLParams["name"])
 	log.Printf("rm version => %s\n", c.URLParams["version"])
+	depKey := depKeyOf(c, r)
+	log.Printf("rm deps => %s\n", depKey)
 
 	name := c.URLParams["name"]
 	version := c.URLParams["version"]
 
-	if err := gSubakoCtx.RemovePackage(name, version); err != nil {
+	preview, err := gSubakoCtx.PreviewRemoval(name, version, depKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	modeValue := ""
+	if r.Method == "POST" {
+		modeValue = r.PostFormValue("mode")
+	}
+
+	// ask what to do with dependents
+	if modeValue == "" && len(preview.Dependents) > 0 {
+		tpl, err := pongo2.DefaultSet.FromFile("remove_package.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tpl.ExecuteWriter(withUser(c, pongo2.Context{
+			"report": preview,
+			"name": name,
+			"version": version,
+			"dep_key": depKey,
+		}), w)
+		return
+	}
+
+	mode, err := subako.ParseRemovalMode(modeValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// values before the removal for the audit log
+	befores := make(map[string]interface{})
+	if a, err := gSubakoCtx.AvailablePackages.FindDep(subako.PackageName(name), subako.PackageVersion(version), depKey); err == nil {
+		befores[preview.Target] = a
+	}
+	for _, d := range gSubakoCtx.Dependents(name, version, depKey) {
+		d := d
+		befores[subako.PackageTargetID(string(d.Name), string(d.Version), d.DepKey)] = &d
+	}
+
+	report, err := gSubakoCtx.RemovePackageDep(name, version, depKey, mode)
+	if report != nil {
+		actor := actorOf(c, r)
+		for _, target := range report.Removed {
+			gSubakoCtx.Audit.Record(actor, subako.AuditRemovePackage, "package", target, befores[target], nil)
+		}
+		if len(report.Orphaned) > 0 {
+			gSubakoCtx.Audit.Record(actor, subako.AuditOrphanPackages, "package", preview.Target, nil, report.Orphaned)
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*subako.DependentsError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -507,23 +645,84 @@ func removePackage(c web.C, w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/packages", http.StatusSeeOther)
 }
 
-func removePackageDep(c web.C, w http.ResponseWriter, r *http.Request) {
-	log.Printf("rm name => %s\n", c.URLParams["name"])
-	log.Printf("rm version => %s\n", c.URLParams["version"])
-	log.Printf("rm dep name => %s\n", c.URLParams["dep_name"])
-	log.Printf("rm dep version => %s\n", c.URLParams["dep_version"])
+func showOrphansAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-	name := c.URLParams["name"]
-	version := c.URLParams["version"]
-	depName := c.URLParams["dep_name"]
-	depVersion := c.URLParams["dep_version"]
+	report := gSubakoCtx.LastOrphanReport()
+	if r.FormValue("refresh") != "" {
+		report = gSubakoCtx.CheckOrphans()
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(report)
+}
+
+func checkOrphans(c web.C, w http.ResponseWriter, r *http.Request) {
+	gSubakoCtx.CheckOrphans()
 
-	if err := gSubakoCtx.RemovePackageDep(name, version, depName, depVersion); err != nil {
+	http.Redirect(w, r, "/packages", http.StatusSeeOther)
+}
+
+// showReconcile compares available packages with the apt repository.
+// The result of the last repair is shown instead if it is redirected from the repair.
+func showReconcile(c web.C, w http.ResponseWriter, r *http.Request) {
+	tpl, err := pongo2.DefaultSet.FromFile("reconcile.html")
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	http.Redirect(w, r, "/packages", http.StatusSeeOther)
+	report := gSubakoCtx.LastReconcileReport()
+	if report == nil || r.FormValue("repaired") == "" {
+		report, err = gSubakoCtx.Reconcile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
+		"report": report,
+	}), w)
+}
+
+func showReconcileAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	report, err := gSubakoCtx.Reconcile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(report)
+}
+
+func repairReconcile(c web.C, w http.ResponseWriter, r *http.Request) {
+	direction, err := subako.ParseRepairDirection(r.FormValue("direction"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := gSubakoCtx.RepairInconsistencies(direction)
+	if report != nil {
+		gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditReconcileRepair, "package", string(direction), report.Entries, report.Repaired)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(report)
+		return
+	}
+
+	http.Redirect(w, r, "/reconcile?repaired=1", http.StatusSeeOther)
 }
 
 
@@ -533,9 +732,16 @@ func webhookEvent(c web.C, w http.ResponseWriter, r *http.Request) {
 	log.Printf(entryMsg)
 	gSubakoCtx.Logger.Succeeded(entryMsg)
 
+	// count deliveries by outcome
+	outcome := "error"
+	defer func() {
+		gSubakoCtx.Metrics.WebhookDeliveries.WithLabelValues(outcome).Inc()
+	}()
+
 	// get webhook task from database
 	hook, err := gSubakoCtx.Webhooks.GetByTarget(c.URLParams["name"])
 	if err != nil {
+		outcome = "not_found"
 		msg := fmt.Sprintf("Failed to get the webhook task. %s", err)
 		log.Printf(msg)
 		gSubakoCtx.Logger.Failed("webhook", msg)
@@ -544,6 +750,7 @@ func webhookEvent(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 	if hook.Secret == "" {
 		// DO NOTHING
+		outcome = "ignored"
 		gSubakoCtx.Logger.Succeeded("webhook: do nothing")
 		return
 	}
@@ -575,19 +782,30 @@ func webhookEvent(c web.C, w http.ResponseWriter, r *http.Request) {
 	generatedSig := "sha1=" + hex.EncodeToString(expectedMAC)
 
 	if githubSig != generatedSig {
+		outcome = "invalid_signature"
 		msg := "Invalid signature"
 		log.Printf(msg)
 		gSubakoCtx.Logger.Failed("webhook", msg)
 		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	hookActor := subako.Actor{
+		Name: "webhook:" + c.URLParams["name"],
+		SourceIP: r.RemoteAddr,
 	}
 
 	// special
 	if c.URLParams["name"] == packageConfigsHookName {
+		before := configSetsAuditValue()
 		if err := gSubakoCtx.RefreshProfileConfigs(); err != nil {
 			log.Println(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		gSubakoCtx.Audit.Record(hookActor, subako.AuditConfigReload, "config_sets", "", before, configSetsAuditValue())
 
+		outcome = "accepted"
 		return
 	}
 
@@ -599,13 +817,22 @@ func webhookEvent(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := gSubakoCtx.Queue(procConfig); err != nil {
-		msg := "Failed to add the task to queue"
+	queued, err := gSubakoCtx.QueueIfSourceChanged(procConfig)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to add the task to queue. %s", err)
+		gSubakoCtx.Logger.Failed("webhook", msg)
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
+	if !queued {
+		outcome = "unchanged"
+		gSubakoCtx.Logger.Succeeded("webhook: source is not changed")
+		return
+	}
+	gSubakoCtx.Audit.Record(hookActor, subako.AuditQueue, "package", subako.BuildConfigTargetID(procConfig), nil, nil)
 
 	// succeeded
+	outcome = "accepted"
 	gSubakoCtx.Logger.Succeeded("webhook")
 }
 
@@ -618,9 +845,9 @@ func webhooks(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	tpl.ExecuteWriter(pongo2.Context{
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
 		"webhooks": webhooks,
-	}, w)
+	}), w)
 }
 
 func webhooksAppend(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -652,6 +879,7 @@ func webhooksAppend(c web.C, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditWebhookCreate, "webhook", fmt.Sprintf("%d", hook.ID), nil, hook.AuditValue())
 
 	http.Redirect(w, r, "/webhooks", http.StatusFound)
 }
@@ -688,10 +916,17 @@ func webhooksUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		Version: r.FormValue("version"),
 	}
 
+	before, err := gSubakoCtx.Webhooks.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := gSubakoCtx.Webhooks.Update(uint(id), hook); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditWebhookUpdate, "webhook", c.URLParams["id"], before.AuditValue(), hook.AuditValue())
 
 	http.Redirect(w, r, "/webhooks", http.StatusFound)
 }
@@ -704,10 +939,17 @@ func webhooksDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before, err := gSubakoCtx.Webhooks.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := gSubakoCtx.Webhooks.Delete(uint(id)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditWebhookDelete, "webhook", c.URLParams["id"], before.AuditValue(), nil)
 
 	http.Redirect(w, r, "/webhooks", http.StatusFound)
 }
@@ -722,11 +964,11 @@ func dailyTasks(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	tpl.ExecuteWriter(pongo2.Context{
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
 		"tasks": tasks,
 		"point": gSubakoCtx.DailyTasks.Point,
 		"now": time.Now(),
-	}, w)
+	}), w)
 }
 
 func dailyTasksAppend(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -748,6 +990,7 @@ func dailyTasksAppend(c web.C, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditDailyTaskCreate, "daily_task", fmt.Sprintf("%d", task.ID), nil, task.AuditValue())
 
 	http.Redirect(w, r, "/daily_tasks", http.StatusFound)
 }
@@ -774,10 +1017,17 @@ func dailyTasksUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		Version: r.FormValue("version"),
 	}
 
+	before, err := gSubakoCtx.DailyTasks.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := gSubakoCtx.DailyTasks.Update(uint(id), task); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditDailyTaskUpdate, "daily_task", c.URLParams["id"], before.AuditValue(), task.AuditValue())
 
 	http.Redirect(w, r, "/daily_tasks", http.StatusFound)
 }
@@ -790,35 +1040,342 @@ func dailyTasksDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before, err := gSubakoCtx.DailyTasks.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := gSubakoCtx.DailyTasks.Delete(uint(id)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditDailyTaskDelete, "daily_task", c.URLParams["id"], before.AuditValue(), nil)
 
 	http.Redirect(w, r, "/daily_tasks", http.StatusFound)
 }
 
 
+func users(c web.C, w http.ResponseWriter, r *http.Request) {
+	users := gSubakoCtx.Users.GetUsers()
+
+	tpl, err := pongo2.DefaultSet.FromFile("users.html")
+	if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
+		"users": users,
+		"roles": []subako.UserRole{subako.RoleViewer, subako.RoleBuilder, subako.RoleAdmin},
+	}), w)
+}
+
+func usersAppend(c web.C, w http.ResponseWriter, r *http.Request) {
+	role, err := subako.ParseUserRole(r.FormValue("role"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := gSubakoCtx.Users.Append(r.FormValue("name"), r.FormValue("password"), role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditUserCreate, "user", fmt.Sprintf("%d", user.ID), nil, user.AuditValue())
+
+	http.Redirect(w, r, "/users", http.StatusFound)
+}
+
+func usersUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
+	log.Printf("User Id => %s\n", c.URLParams["id"])
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusInternalServerError)
+		return
+	}
+
+	role, err := subako.ParseUserRole(r.FormValue("role"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// do not allow to drop own admin role
+	if uint(id) == currentUser(c).ID && role != subako.RoleAdmin {
+		http.Error(w, "cannot change your own role", http.StatusInternalServerError)
+		return
+	}
+
+	before, err := gSubakoCtx.Users.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// empty password means "not changed"
+	if err := gSubakoCtx.Users.Update(uint(id), r.FormValue("name"), r.FormValue("password"), role); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	after := map[string]string{
+		"name": r.FormValue("name"),
+		"role": role.String(),
+	}
+	if r.FormValue("password") != "" {
+		after["password"] = "(changed)"
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditUserUpdate, "user", c.URLParams["id"], before.AuditValue(), after)
+
+	http.Redirect(w, r, "/users", http.StatusFound)
+}
+
+func usersDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	log.Printf("User Id => %s\n", c.URLParams["id"])
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusInternalServerError)
+		return
+	}
+
+	if uint(id) == currentUser(c).ID {
+		http.Error(w, "cannot delete yourself", http.StatusInternalServerError)
+		return
+	}
+
+	before, err := gSubakoCtx.Users.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := gSubakoCtx.Users.Delete(uint(id)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditUserDelete, "user", c.URLParams["id"], before.AuditValue(), nil)
+
+	http.Redirect(w, r, "/users", http.StatusFound)
+}
+
+
+func apiTokens(c web.C, w http.ResponseWriter, r *http.Request) {
+	renderApiTokens(c, w, "")
+}
+
+func renderApiTokens(c web.C, w http.ResponseWriter, createdToken string) {
+	user := currentUser(c)
+	tokens := gSubakoCtx.ApiTokens.GetTokens(user)
+
+	tpl, err := pongo2.DefaultSet.FromFile("api_tokens.html")
+	if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
+		"tokens": tokens,
+		"created_token": createdToken,
+		"scopes": []subako.TokenScope{subako.ScopeRead, subako.ScopeQueue, subako.ScopeAdmin},
+	}), w)
+}
+
+func apiTokensCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	kind, err := subako.ParseTokenKind(r.FormValue("kind"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scope, err := subako.ParseTokenScope(r.FormValue("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	days, err := strconv.ParseUint(r.FormValue("expires_in_days"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid expires_in_days", http.StatusInternalServerError)
+		return
+	}
+
+	plain, token, err := gSubakoCtx.ApiTokens.Create(
+		currentUser(c),
+		r.FormValue("name"),
+		kind,
+		scope,
+		time.Duration(days) * 24 * time.Hour,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditApiTokenCreate, "api_token", fmt.Sprintf("%d", token.ID), nil, token.AuditValue())
+
+	// the plain token is shown only once
+	renderApiTokens(c, w, plain)
+}
+
+func apiTokensRevoke(c web.C, w http.ResponseWriter, r *http.Request) {
+	log.Printf("ApiToken Id => %s\n", c.URLParams["id"])
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusInternalServerError)
+		return
+	}
+
+	before, err := gSubakoCtx.ApiTokens.Get(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := gSubakoCtx.ApiTokens.Revoke(uint(id), currentUser(c)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditApiTokenRevoke, "api_token", c.URLParams["id"], before.AuditValue(), nil)
+
+	http.Redirect(w, r, "/api_tokens", http.StatusFound)
+}
+
+
 func updateProcConfigSets(c web.C, w http.ResponseWriter, r *http.Request) {
+	before := configSetsAuditValue()
 	if err := gSubakoCtx.RefreshProfileConfigs(); err != nil {
 		log.Println(err.Error())
+		if subako.AsConfigErrors(err) != nil {
+			// problems are shown in the top page
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditConfigReload, "config_sets", "", before, configSetsAuditValue())
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// switchConfigSetsRef checks out the branch, tag or commit of remote config sets. An empty ref resets to the ref in config.yml.
+func switchConfigSetsRef(c web.C, w http.ResponseWriter, r *http.Request) {
+	before := configSetsAuditValue()
+	if err := gSubakoCtx.SwitchConfigSetsRef(strings.TrimSpace(r.FormValue("ref"))); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditConfigRefSwitch, "config_sets", "", before, configSetsAuditValue())
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func regenerateProfiles(c web.C, w http.ResponseWriter, r *http.Request) {
+	before := map[string]int{"profiles": len(gSubakoCtx.Profiles.Profiles)}
 	if err := gSubakoCtx.UpdateProfilesWithNotification(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	gSubakoCtx.Audit.Record(actorOf(c, r), subako.AuditProfilesRegenerate, "profiles", "", before, map[string]int{
+		"profiles": len(gSubakoCtx.Profiles.Profiles),
+	})
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 
+// configSetsAuditValue returns a summary of the current config sets for the audit log
+func configSetsAuditValue() map[string]interface{} {
+	ctx := gSubakoCtx.ProcConfigSetsCtx
+	snapshot := ctx.Snapshot()
+
+	v := map[string]interface{}{
+		"packages": len(snapshot.Map),
+	}
+	if ctx.IsRemote {
+		v["revision"] = snapshot.Revision
+		v["ref"] = ctx.Ref()
+	}
+
+	return v
+}
+
+
+func showAuditLogs(c web.C, w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filter.Limit = 200
+
+	tpl, err := pongo2.DefaultSet.FromFile("audit_logs.html")
+	if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
+		"logs": gSubakoCtx.Audit.Find(filter),
+		"form": map[string]string{
+			"actor": r.FormValue("actor"),
+			"action": r.FormValue("action"),
+			"target_type": r.FormValue("target_type"),
+			"target_id": r.FormValue("target_id"),
+			"since": r.FormValue("since"),
+			"until": r.FormValue("until"),
+		},
+		"query": r.URL.RawQuery,
+	}), w)
+}
+
+func exportAuditLogs(c web.C, w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit_logs.jsonl\"")
+
+	if err := subako.WriteAuditJSONLines(w, gSubakoCtx.Audit.Find(filter)); err != nil {
+		log.Printf("Failed to export audit logs: %v", err)
+	}
+}
+
+func auditFilterFromRequest(r *http.Request) (*subako.AuditFilter, error) {
+	const dateLayout = "2006-01-02"
+
+	filter := &subako.AuditFilter{
+		Actor: r.FormValue("actor"),
+		Action: r.FormValue("action"),
+		TargetType: r.FormValue("target_type"),
+		TargetID: r.FormValue("target_id"),
+	}
+
+	if v := r.FormValue("since"); v != "" {
+		t, err := time.ParseInLocation(dateLayout, v, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since: %v", err)
+		}
+		filter.Since = t
+	}
+	if v := r.FormValue("until"); v != "" {
+		t, err := time.ParseInLocation(dateLayout, v, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until: %v", err)
+		}
+		filter.Until = t.AddDate(0, 0, 1)	// inclusive
+	}
+
+	return filter, nil
+}
+
+
 func showMiniLogs(c web.C, w http.ResponseWriter, r *http.Request) {
 	tpl, err := pongo2.DefaultSet.FromFile("system_logs.html")
 	if err != nil {
@@ -828,9 +1385,9 @@ func showMiniLogs(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	latestLogs := gSubakoCtx.Logger.GetLatest(50)
 
-	tpl.ExecuteWriter(pongo2.Context{
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
 		"latest_logs": latestLogs,
-	}, w)
+	}), w)
 }
 
 
@@ -841,7 +1398,7 @@ func showInfo(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	tpl.ExecuteWriter(pongo2.Context{}, w)
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{}), w)
 }
 
 
@@ -853,3 +1410,152 @@ func showProfilesAPI(c web.C, w http.ResponseWriter, r *http.Request) {
 	encoder := json.NewEncoder(w)
     encoder.Encode(profiles)
 }
+
+// language => alias => resolved version
+func showProfileAliasesAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	aliases := gSubakoCtx.Profiles.Aliases()
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(aliases)
+}
+
+
+// problems in config sets which are found by the last reload
+func showConfigErrorsAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	errs := gSubakoCtx.ProcConfigSetsCtx.ConfigErrors()
+	if errs == nil {
+		errs = subako.ConfigErrors{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(map[string]interface{}{
+		"ok": len(errs) == 0,
+		"errors": errs,
+	})
+}
+
+// configHistoryView is a loaded revision of config sets with tasks which were started with it
+type configHistoryView struct {
+	ID			uint					`json:"id"`
+	LoadedAt	time.Time				`json:"loaded_at"`
+	Revision	string					`json:"revision"`
+	Ref			string					`json:"ref"`
+	Current		bool					`json:"current"`
+	Diff		*subako.ConfigDiff		`json:"diff"`
+	Tasks		[]*subako.RunningTask	`json:"-"`
+	TaskIDs		[]int					`json:"task_ids"`
+}
+
+func makeConfigHistoryViews(limit int) []*configHistoryView {
+	histories := gSubakoCtx.ProcConfigSetsCtx.History.Find(limit)
+	currentID := gSubakoCtx.ProcConfigSetsCtx.CurrentHistoryID()
+
+	views := make([]*configHistoryView, len(histories))
+	for i, h := range histories {
+		v := &configHistoryView{
+			ID: h.ID,
+			LoadedAt: h.CreatedAt,
+			Revision: h.Revision,
+			Ref: h.Ref,
+			Current: h.ID == currentID,
+			Diff: h.GetDiff(),
+			Tasks: gSubakoCtx.RunningTasks.FindByConfigHistory(h.ID),
+			TaskIDs: make([]int, 0),
+		}
+		for _, task := range v.Tasks {
+			v.TaskIDs = append(v.TaskIDs, task.Id)
+		}
+		views[i] = v
+	}
+
+	return views
+}
+
+func showConfigHistory(c web.C, w http.ResponseWriter, r *http.Request) {
+	tpl, err := pongo2.DefaultSet.FromFile("config_history.html")
+	if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+	tpl.ExecuteWriter(withUser(c, pongo2.Context{
+		"histories": makeConfigHistoryViews(50),
+	}), w)
+}
+
+func showConfigHistoryAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(makeConfigHistoryViews(limit))
+}
+
+func showSchemas(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	urls := make(map[string]string)
+	for _, name := range subako.ConfigSchemaNames() {
+		urls[name] = "/schemas/" + name + ".json"
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(urls)
+}
+
+func showSchema(c web.C, w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(c.URLParams["name"], ".json")
+	schema, err := subako.ConfigSchema(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(schema)
+}
+
+func showTasksAPI(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	tasks := gSubakoCtx.RunningTasks.MakeDisplayTask()
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(tasks)
+}
+
+
+// the process is alive
+func healthz(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// the process can build packages
+func readyz(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	report := gSubakoCtx.CheckReadiness()
+	if report.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(report)
+}
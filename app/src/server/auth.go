@@ -0,0 +1,137 @@
+package main
+
+import (
+	"subako"
+
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+	"github.com/flosch/pongo2"
+)
+
+const authRealm = "TorigoyaFactory"
+const userEnvKey = "user"
+
+
+// authenticate sets the user to the environment when the request has valid credentials.
+// Both of basic auth and "Authorization: Bearer <API token>" are accepted.
+// Requests without credentials are passed as anonymous.
+func authenticate(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if token := bearerToken(r); token != "" {
+			user, err := gSubakoCtx.ApiTokens.Authenticate(token, r.RemoteAddr)
+			if err != nil {
+				// do not fall back to anonymous, clients must know the token is wrong
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			c.Env[userEnvKey] = user
+
+		} else if name, password, ok := r.BasicAuth(); ok {
+			if user, err := gSubakoCtx.Users.Authenticate(name, password); err == nil {
+				c.Env[userEnvKey] = user
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// requireLogin rejects anonymous requests
+func requireLogin(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(*c) == nil {
+			unauthorized(w)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// requireRole allows only users who have the role (or a stronger one) to call the handler
+func requireRole(role subako.UserRole, h web.HandlerFunc) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+		user := currentUser(c)
+		if user == nil {
+			unauthorized(w)
+			return
+		}
+		if !user.HasRole(role) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		h(c, w, r)
+	}
+}
+
+// requirePassword rejects requests authenticated by API tokens
+func requirePassword(h web.HandlerFunc) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+		user := currentUser(c)
+		if user == nil {
+			unauthorized(w)
+			return
+		}
+		if user.AuthToken != "" {
+			http.Error(w, "API tokens cannot be used here", http.StatusForbidden)
+			return
+		}
+
+		h(c, w, r)
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"" + authRealm + "\"")
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func currentUser(c web.C) *subako.User {
+	if user, ok := c.Env[userEnvKey].(*subako.User); ok {
+		return user
+	}
+
+	return nil
+}
+
+// actorOf returns the actor of the request for the audit log
+func actorOf(c web.C, r *http.Request) subako.Actor {
+	name := "anonymous"
+	if user := currentUser(c); user != nil {
+		name = user.ActorName()
+	}
+
+	return subako.Actor{
+		Name: name,
+		SourceIP: r.RemoteAddr,
+	}
+}
+
+// withUser adds the user information to the template context to show only allowed actions
+func withUser(c web.C, ctx pongo2.Context) pongo2.Context {
+	user := currentUser(c)
+
+	ctx["user"] = user
+	ctx["can_build"] = user.CanBuild()
+	ctx["can_admin"] = user.CanAdmin()
+
+	return ctx
+}
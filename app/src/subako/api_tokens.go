@@ -0,0 +1,260 @@
+package subako
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/jinzhu/gorm"
+)
+
+
+const apiTokenPrefix = "sbk_"
+
+type TokenScope int
+const (
+	ScopeRead = TokenScope(1)
+	ScopeQueue = TokenScope(2)
+	ScopeAdmin = TokenScope(3)
+)
+
+func (s TokenScope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read-only"
+	case ScopeQueue:
+		return "queue"
+	case ScopeAdmin:
+		return "admin"
+	}
+	return ""
+}
+
+// Role returns the strongest role which is allowed by the scope
+func (s TokenScope) Role() UserRole {
+	switch s {
+	case ScopeRead:
+		return RoleViewer
+	case ScopeQueue:
+		return RoleBuilder
+	case ScopeAdmin:
+		return RoleAdmin
+	}
+	return RoleNone
+}
+
+func ParseTokenScope(s string) (TokenScope, error) {
+	switch s {
+	case "read-only":
+		return ScopeRead, nil
+	case "queue":
+		return ScopeQueue, nil
+	case "admin":
+		return ScopeAdmin, nil
+	}
+	return TokenScope(0), fmt.Errorf("Unknown scope: %s", s)
+}
+
+
+type TokenKind int
+const (
+	TokenPersonal = TokenKind(0)	// acts as the owner
+	TokenService = TokenKind(1)		// acts as a service which is not bound to any user
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenPersonal:
+		return "personal"
+	case TokenService:
+		return "service"
+	}
+	return ""
+}
+
+func ParseTokenKind(s string) (TokenKind, error) {
+	switch s {
+	case "personal":
+		return TokenPersonal, nil
+	case "service":
+		return TokenService, nil
+	}
+	return TokenKind(0), fmt.Errorf("Unknown token kind: %s", s)
+}
+
+
+type ApiToken struct {
+	gorm.Model
+	Name			string
+	Kind			TokenKind
+	UserID			uint		// owner (creator of service tokens)
+	Scope			TokenScope
+	TokenHash		string		`sql:"unique"`	// only the hash is stored
+	ExpiresAt		time.Time
+	LastUsedAt		*time.Time
+	LastUsedFrom	string
+}
+
+func (t *ApiToken) IsExpired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
+
+// AuditValue returns the values which are recorded to the audit log (the hash is not included)
+func (t *ApiToken) AuditValue() map[string]string {
+	return map[string]string{
+		"name": t.Name,
+		"kind": t.Kind.String(),
+		"scope": t.Scope.String(),
+		"expires_at": t.ExpiresAt.String(),
+	}
+}
+
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type ApiTokensContext struct {
+	Db		gorm.DB
+	Users	*UsersContext
+}
+
+func MakeApiTokensContext(db gorm.DB, users *UsersContext) (*ApiTokensContext, error) {
+	db.AutoMigrate(&ApiToken{})
+
+	return &ApiTokensContext{
+		Db: db,
+		Users: users,
+	}, nil
+}
+
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetTokens returns tokens which the user can see. Admins can see all tokens.
+func (ctx *ApiTokensContext) GetTokens(user *User) []ApiToken {
+	tokens := []ApiToken{}
+	if user.CanAdmin() {
+		ctx.Db.Debug().Order("created_at desc").Find(&tokens)
+	} else {
+		ctx.Db.Debug().Where(&ApiToken{UserID: user.ID, Kind: TokenPersonal}).Order("created_at desc").Find(&tokens)
+	}
+
+	return tokens
+}
+
+// Create makes a new token and returns its plain text. The plain text cannot be got again.
+func (ctx *ApiTokensContext) Create(
+	owner		*User,
+	name		string,
+	kind		TokenKind,
+	scope		TokenScope,
+	expiresIn	time.Duration,
+) (string, *ApiToken, error) {
+	if name == "" {
+		return "", nil, errors.New("name is empty")
+	}
+	if expiresIn <= 0 {
+		return "", nil, errors.New("expiry must be in the future")
+	}
+	if kind == TokenService && !owner.CanAdmin() {
+		return "", nil, errors.New("only admins can create service tokens")
+	}
+	if !owner.HasRole(scope.Role()) {
+		return "", nil, fmt.Errorf("scope %s exceeds your role", scope)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	plain := apiTokenPrefix + hex.EncodeToString(buf)
+
+	token := &ApiToken{
+		Name: name,
+		Kind: kind,
+		UserID: owner.ID,
+		Scope: scope,
+		TokenHash: hashApiToken(plain),
+		ExpiresAt: time.Now().Add(expiresIn),
+	}
+	if err := ctx.Db.Debug().Create(token).Error; err != nil {
+		return "", nil, err
+	}
+
+	return plain, token, nil
+}
+
+func (ctx *ApiTokensContext) Get(id uint) (*ApiToken, error) {
+	token := ApiToken{}
+	if err := ctx.Db.Debug().First(&token, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Revoke deletes the token. Users can revoke own tokens, admins can revoke all tokens.
+func (ctx *ApiTokensContext) Revoke(id uint, user *User) error {
+	token, err := ctx.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if token.UserID != user.ID && !user.CanAdmin() {
+		return errors.New("the token is not yours")
+	}
+
+	return ctx.Db.Debug().Delete(token).Error
+}
+
+// Authenticate returns a user which acts as the token. The role of the user is restricted by the scope.
+func (ctx *ApiTokensContext) Authenticate(plain, remoteAddr string) (*User, error) {
+	token := ApiToken{}
+	if err := ctx.Db.Where(&ApiToken{TokenHash: hashApiToken(plain)}).First(&token).Error; err != nil {
+		return nil, ErrInvalidToken
+	}
+	if token.IsExpired() {
+		return nil, ErrInvalidToken
+	}
+
+	var user User
+	switch token.Kind {
+	case TokenPersonal:
+		owner, err := ctx.Users.Get(token.UserID)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		user = *owner
+		if token.Scope.Role() < user.Role {
+			user.Role = token.Scope.Role()
+		}
+
+	case TokenService:
+		// the token must not exceed the current role of the admin who created it
+		creator, err := ctx.Users.Get(token.UserID)
+		if err != nil || !creator.HasRole(token.Scope.Role()) {
+			return nil, ErrInvalidToken
+		}
+		user = User{
+			Name: "service:" + token.Name,
+			Role: token.Scope.Role(),
+		}
+
+	default:
+		return nil, ErrInvalidToken
+	}
+	user.AuthToken = token.Name
+
+	// record the last use
+	now := time.Now()
+	ctx.Db.Model(&token).UpdateColumn(map[string]interface{}{
+		"last_used_at": now,
+		"last_used_from": remoteAddr,
+	})
+
+	return &user, nil
+}
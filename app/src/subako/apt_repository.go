@@ -4,11 +4,17 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"reprepro"
 )
 
 
 type AptRepositoryContext struct {
+	size					int64		// cached, because the tree is large to walk on every scrape of metrics (first for 64bit atomic access)
+
 	AptRepositoryBaseDir	string
 	reprepro				*reprepro.Reprepro
 }
@@ -23,16 +29,30 @@ func MakeAptRepositoryContext(
 		}
 	}
 
-	return &AptRepositoryContext{
+	ctx := &AptRepositoryContext{
 		AptRepositoryBaseDir: aptRepositoryBaseDir,
 		reprepro: &reprepro.Reprepro{
 			RepositoryPath: aptRepositoryBaseDir,
 			CodeName: "trusty",		// for 14.04 LTS
 		},
-	}, nil
+	}
+	ctx.refreshSize()
+
+	return ctx, nil
+}
+
+// Size returns the total size of files in the repository when it was changed last
+func (ctx *AptRepositoryContext) Size() int64 {
+	return atomic.LoadInt64(&ctx.size)
+}
+
+func (ctx *AptRepositoryContext) refreshSize() {
+	atomic.StoreInt64(&ctx.size, dirSize(ctx.AptRepositoryBaseDir))
 }
 
 func (ctx *AptRepositoryContext) AddPackage(debPath string) error {
+	defer ctx.refreshSize()
+
 	args := ctx.reprepro.MakeAddCommand(debPath)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
@@ -47,6 +67,8 @@ func (ctx *AptRepositoryContext) AddPackage(debPath string) error {
 func (ctx *AptRepositoryContext) RemovePackage(pkgName string) error {
 	log.Printf("REMOVE: repoPath(%s)", ctx.reprepro.RepositoryPath)
 
+	defer ctx.refreshSize()
+
 	args := ctx.reprepro.MakeRemoveCommand(pkgName)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
@@ -56,3 +78,18 @@ func (ctx *AptRepositoryContext) RemovePackage(pkgName string) error {
 
 	return nil
 }
+
+// ListPackages returns packages which are published in the repository
+func (ctx *AptRepositoryContext) ListPackages() ([]reprepro.ListEntry, error) {
+	args := ctx.reprepro.MakeLsCommand()
+	cmd := exec.Command(args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return reprepro.ParseListOutput(stdout.String()), nil
+}
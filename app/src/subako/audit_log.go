@@ -0,0 +1,187 @@
+package subako
+
+import (
+	"log"
+	"io"
+	"time"
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+)
+
+
+// Actor is who did an action
+type Actor struct {
+	Name		string
+	SourceIP	string
+}
+
+// SystemActor is used for actions which are done by Subako itself (Ex. cron)
+func SystemActor(name string) Actor {
+	return Actor{
+		Name: "system:" + name,
+	}
+}
+
+
+const (
+	AuditBuild = "build"
+	AuditQueue = "queue"
+	AuditAbort = "abort"
+	AuditRemovePackage = "remove_package"
+	AuditOrphanPackages = "orphan_packages"
+	AuditReconcileRepair = "reconcile.repair"
+	AuditWebhookCreate = "webhook.create"
+	AuditWebhookUpdate = "webhook.update"
+	AuditWebhookDelete = "webhook.delete"
+	AuditDailyTaskCreate = "daily_task.create"
+	AuditDailyTaskUpdate = "daily_task.update"
+	AuditDailyTaskDelete = "daily_task.delete"
+	AuditConfigReload = "config.reload"
+	AuditConfigRefSwitch = "config.ref_switch"
+	AuditProfilesRegenerate = "profiles.regenerate"
+	AuditUserCreate = "user.create"
+	AuditUserUpdate = "user.update"
+	AuditUserDelete = "user.delete"
+	AuditApiTokenCreate = "api_token.create"
+	AuditApiTokenRevoke = "api_token.revoke"
+)
+
+
+type AuditLog struct {
+	gorm.Model
+	Actor		string
+	SourceIP	string
+	Action		string
+	TargetType	string
+	TargetID	string
+	Before		string		`sql:"type:text"`	// JSON
+	After		string		`sql:"type:text"`	// JSON
+}
+
+type AuditFilter struct {
+	Actor		string		// partial match
+	Action		string
+	TargetType	string
+	TargetID	string		// partial match
+	Since		time.Time
+	Until		time.Time
+	Limit		int			// 0 means no limit
+}
+
+type AuditLogContext struct {
+	Db		gorm.DB
+}
+
+func MakeAuditLogContext(db gorm.DB) (*AuditLogContext, error) {
+	db.AutoMigrate(&AuditLog{})
+
+	return &AuditLogContext{
+		Db: db,
+	}, nil
+}
+
+func auditValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	buffer, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(buffer)
+}
+
+// Record appends an audit entry. Failures are only logged so that the action itself is not affected.
+func (ctx *AuditLogContext) Record(
+	actor			Actor,
+	action			string,
+	targetType		string,
+	targetID		string,
+	before, after	interface{},
+) {
+	entry := &AuditLog{
+		Actor: actor.Name,
+		SourceIP: actor.SourceIP,
+		Action: action,
+		TargetType: targetType,
+		TargetID: targetID,
+		Before: auditValue(before),
+		After: auditValue(after),
+	}
+
+	if err := ctx.Db.Debug().Create(entry).Error; err != nil {
+		log.Printf("Failed to record the audit log: %v / %v", err, entry)
+	}
+}
+
+func (ctx *AuditLogContext) Find(filter *AuditFilter) []AuditLog {
+	q := ctx.Db.Debug().Order("created_at desc")
+
+	if filter.Actor != "" {
+		q = q.Where("actor LIKE ?", "%" + filter.Actor + "%")
+	}
+	if filter.Action != "" {
+		q = q.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		q = q.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		q = q.Where("target_id LIKE ?", "%" + filter.TargetID + "%")
+	}
+	if !filter.Since.IsZero() {
+		q = q.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		q = q.Where("created_at < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+
+	logs := []AuditLog{}
+	q.Find(&logs)
+
+	return logs
+}
+
+type auditLogLine struct {
+	Time		time.Time		`json:"time"`
+	Actor		string			`json:"actor"`
+	SourceIP	string			`json:"source_ip"`
+	Action		string			`json:"action"`
+	TargetType	string			`json:"target_type"`
+	TargetID	string			`json:"target_id"`
+	Before		json.RawMessage	`json:"before,omitempty"`
+	After		json.RawMessage	`json:"after,omitempty"`
+}
+
+// WriteAuditJSONLines writes logs as JSON Lines (one object per line)
+func WriteAuditJSONLines(w io.Writer, logs []AuditLog) error {
+	encoder := json.NewEncoder(w)
+	for _, l := range logs {
+		line := auditLogLine{
+			Time: l.CreatedAt,
+			Actor: l.Actor,
+			SourceIP: l.SourceIP,
+			Action: l.Action,
+			TargetType: l.TargetType,
+			TargetID: l.TargetID,
+		}
+		if l.Before != "" {
+			line.Before = json.RawMessage(l.Before)
+		}
+		if l.After != "" {
+			line.After = json.RawMessage(l.After)
+		}
+
+		if err := encoder.Encode(&line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
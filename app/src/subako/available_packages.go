@@ -1,13 +1,14 @@
 package subako
 
 import (
-	"encoding/json"
 	"regexp"
 	"time"
-	"io/ioutil"
 	"log"
 	"fmt"
 	"sync"
+	"sort"
+
+	"github.com/jinzhu/gorm"
 )
 
 
@@ -23,8 +24,13 @@ type AvailablePackage struct {
 	InstallBase					string
 	InstallPrefix				string
 
-	DepName						PackageName
+	DepName						PackageName		// the first dependency
 	DepVersion					PackageVersion
+	DepKey						string			// key of all dependencies (empty if there are no deps)
+
+	ConfigFingerprint			string		// fingerprint of the config dir which was used to build (empty if unknown)
+	SourceCommit				string		// commit of the source which was built (empty if the package has no source)
+	Orphaned					bool		// some dependencies have been removed
 }
 
 var (
@@ -36,6 +42,14 @@ var (
 	reUndef = regexp.MustCompile("%{.*}")
 )
 
+// placeholders which can be used in profile templates
+var knownPlaceholders = []string{
+	"install_base",
+	"install_prefix",
+	"version",
+	"display_version",
+}
+
 func (ap *AvailablePackage) ReplaceString(s string) (string, error) {
 	s = reInstallBase.ReplaceAllString(s, ap.InstallBase)
 	s = reInstallPrefix.ReplaceAllString(s, ap.InstallPrefix)
@@ -51,63 +65,63 @@ func (ap *AvailablePackage) ReplaceString(s string) (string, error) {
 	return s, nil
 }
 
-type AvailablePackagesDepVerMap map[PackageVersion]AvailablePackage
-type AvailablePackagesDepNameMap map[PackageName]AvailablePackagesDepVerMap
+// GetDeps returns all dependencies which the package was built with
+func (a AvailablePackage) GetDeps() DepTuple {
+	deps, err := ParseDepKey(a.DepKey)
+	if err != nil {
+		log.Printf("Broken dep key of (%s, %s): %v", a.Name, a.Version, err)
+	}
+	return deps
+}
 
-type AvailablePackagesVerMap map[PackageVersion]AvailablePackagesDepNameMap
+// normalizeDepKey fills DepKey of packages which were built before tuples were recorded
+func (a *AvailablePackage) normalizeDepKey() {
+	if a.DepKey == "" {
+		a.DepKey = singleDepKey(a.DepName, a.DepVersion)
+	}
+}
+
+type AvailablePackagesDepMap map[string]AvailablePackage		// dep key => package
+
+type AvailablePackagesVerMap map[PackageVersion]AvailablePackagesDepMap
 
 type AvailablePackages struct {
 	LastUpdated		int64					// Unix time
 	Packages		map[PackageName]AvailablePackagesVerMap
 
-	FilePath		string		`json:"-"`	// ignore
+	storage			*Storage
 	m				sync.Mutex	`json:"-"`	// ignore
 }
 
-func LoadAvailablePackages(path string) (*AvailablePackages, error) {
-	if !Exists(path) {
-		return &AvailablePackages{
-			LastUpdated: 0,
-			Packages: make(map[PackageName]AvailablePackagesVerMap),
-			FilePath: path,
-		}, nil
-	}
-
-	buffer, err := ioutil.ReadFile(path)
-    if err != nil {
+func LoadAvailablePackages(storage *Storage) (*AvailablePackages, error) {
+	records := []packageRecord{}
+	if err := storage.Db.Debug().Find(&records).Error; err != nil {
 		return nil, err
-    }
-
-	var ap AvailablePackages
-	if err := json.Unmarshal(buffer, &ap); err != nil {
-		return nil, fmt.Errorf("%s : %v", path, err)
 	}
-	ap.FilePath = path
-
-	return &ap, nil
-}
-
-func (ap *AvailablePackages) Save() error {
-	ap.m.Lock()
-	defer ap.m.Unlock()
 
-	buffer, err := json.Marshal(ap)
-	if err != nil {
-		return err
+	ap := &AvailablePackages{
+		LastUpdated: 0,
+		Packages: make(map[PackageName]AvailablePackagesVerMap),
+		storage: storage,
 	}
-	if err := ioutil.WriteFile(ap.FilePath, buffer, 0644); err != nil {
-		return err
+	for _, r := range records {
+		a := r.AvailablePackage
+		a.normalizeDepKey()
+		ap.fillNil(a.Name, a.Version)
+		ap.Packages[a.Name][a.Version][a.DepKey] = a
+
+		if r.UpdatedAt.Unix() > ap.LastUpdated {
+			ap.LastUpdated = r.UpdatedAt.Unix()
+		}
 	}
 
-	return nil
+	return ap, nil
 }
 
 
 func (ap *AvailablePackages) fillNil(
 	pkgName			PackageName,
 	pkgVersion		PackageVersion,
-	depPkgName		PackageName,
-	depPkgVersion	PackageVersion,
 ) {
 	if ap.Packages == nil {
 		ap.Packages = make(map[PackageName]AvailablePackagesVerMap)
@@ -118,25 +132,37 @@ func (ap *AvailablePackages) fillNil(
 	}
 
 	if _, ok := ap.Packages[pkgName][pkgVersion]; !ok {
-		ap.Packages[pkgName][pkgVersion] = make(AvailablePackagesDepNameMap)
-	}
-
-	if _, ok := ap.Packages[pkgName][pkgVersion][depPkgName]; !ok {
-		ap.Packages[pkgName][pkgVersion][depPkgName] = make(AvailablePackagesDepVerMap)
+		ap.Packages[pkgName][pkgVersion] = make(AvailablePackagesDepMap)
 	}
 }
 
 
+// Update saves the package to the database and the memory.
+// with is called in the same transaction to make other changes atomic (can be nil).
 func (ap *AvailablePackages) Update(
 	a *AvailablePackage,
+	with func(tx *gorm.DB) error,
 ) error {
 	ap.m.Lock()
 	defer ap.m.Unlock()
 
+	a.normalizeDepKey()
 	log.Printf("Update AvailablePackages => %v", *a)
 
-	ap.fillNil(a.Name, a.Version, a.DepName, a.DepVersion)
-	ap.Packages[a.Name][a.Version][a.DepName][a.DepVersion] = *a
+	if err := ap.storage.Transaction(func(tx *gorm.DB) error {
+		if err := savePackageRecord(tx, a); err != nil {
+			return err
+		}
+		if with != nil {
+			return with(tx)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	ap.fillNil(a.Name, a.Version)
+	ap.Packages[a.Name][a.Version][a.DepKey] = *a
 
 	ap.LastUpdated = time.Now().Unix()
 
@@ -148,7 +174,7 @@ func (ap *AvailablePackages) Update(
 
 func (ap *AvailablePackages) Remove(
 	name, version		string,
-	depName, depVersion	string,
+	depKey				string,
 ) error {
 	ap.m.Lock()
 	defer ap.m.Unlock()
@@ -159,18 +185,19 @@ func (ap *AvailablePackages) Remove(
 
 	log.Printf("removing => %s / %s", name, version)
 
+	if _, ok := ap.Packages[PackageName(name)]; !ok {
+		return fmt.Errorf("There are no packages named %s", name)
+	}
+	if err := ap.storage.Transaction(func(tx *gorm.DB) error {
+		return deletePackageRecord(tx, PackageName(name), PackageVersion(version), depKey)
+	}); err != nil {
+		return err
+	}
+
 	if packages, ok := ap.Packages[PackageName(name)]; ok {
 		// has 'name' key
 		if depPkgMap, ok := packages[PackageVersion(version)]; ok {
-			if depPkgVerMap, ok := depPkgMap[PackageName(depName)]; ok {
-				if _, ok := depPkgVerMap[PackageVersion(depVersion)]; ok {
-					delete(depPkgVerMap,PackageVersion(depVersion))
-				}
-
-				if len(depPkgVerMap) == 0 {
-					delete(depPkgMap, PackageName(depName))
-				}
-			}
+			delete(depPkgMap, depKey)
 
 			if len(depPkgMap) == 0 {
 				delete(packages, PackageVersion(version))
@@ -198,17 +225,14 @@ func (ap *AvailablePackages) Find(
 	name		PackageName,
 	version		PackageVersion,
 ) (*AvailablePackage, error) {
-	depName := PackageName("")
-	depVersion := PackageVersion("")
-
-	return ap.FindDep(name, version, depName, depVersion)
+	return ap.FindDep(name, version, "")
 }
 
+// FindDep returns the package which was built with the tuple of depKey
 func (ap *AvailablePackages) FindDep(
 	name		PackageName,
 	version		PackageVersion,
-	depName		PackageName,
-	depVersion	PackageVersion,
+	depKey		string,
 ) (*AvailablePackage, error) {
 	ap.m.Lock()
 	defer ap.m.Unlock()
@@ -219,27 +243,66 @@ func (ap *AvailablePackages) FindDep(
 
 	if packages, ok := ap.Packages[name]; ok {
 		if depPkgMap, ok := packages[version]; ok {
-			if depPkgVerMap, ok := depPkgMap[depName]; ok {
-				if pkg, ok := depPkgVerMap[depVersion]; ok {
-					return &pkg, nil
-				}
+			if pkg, ok := depPkgMap[depKey]; ok {
+				return &pkg, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("(%s,%s)[with %s] is not found in available packages", name, version, depKey)
+}
+
+
+// SortedList returns all packages sorted by names, and from the newest version
+func (ap *AvailablePackages) SortedList() []AvailablePackage {
+	ap.m.Lock()
+	defer ap.m.Unlock()
+
+	list := make([]AvailablePackage, 0)
+	for _, packages := range ap.Packages {
+		for _, depPkgMap := range packages {
+			for _, pkg := range depPkgMap {
+				list = append(list, pkg)
 			}
 		}
 	}
+	sort.Stable(availablePackagesOrder(list))
 
-	return nil, fmt.Errorf("(%s,%s)[with %s, %s] is not found in available packages", name, version, depName, depVersion)
+	return list
+}
+
+type availablePackagesOrder []AvailablePackage
+
+func (a availablePackagesOrder) Len() int { return len(a) }
+func (a availablePackagesOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a availablePackagesOrder) Less(i, j int) bool {
+	x, y := a[i], a[j]
+	if x.Name != y.Name {
+		return x.Name < y.Name
+	}
+	if c := CompareVersions(string(x.Version), string(y.Version)); c != 0 {
+		return c > 0
+	}
+	xd, yd := x.GetDeps(), y.GetDeps()
+	for i := 0; i < len(xd) && i < len(yd); i++ {
+		if xd[i].Name != yd[i].Name {
+			return xd[i].Name < yd[i].Name
+		}
+		if c := CompareVersions(string(xd[i].Version), string(yd[i].Version)); c != 0 {
+			return c > 0
+		}
+	}
+	return len(xd) < len(yd)
 }
 
 
-type APWalkFunc func(name PackageName, version PackageVersion, depName PackageName, depVersion PackageVersion, ap *AvailablePackage) error
+type APWalkFunc func(name PackageName, version PackageVersion, depKey string, ap *AvailablePackage) error
 func (ap *AvailablePackages) Walk(f APWalkFunc) error {
 	for name, packages := range ap.Packages {
 		for version, depPkgMap := range packages {
-			for depName, depPkgVerMap := range depPkgMap {
-				for depVersion, pkg := range depPkgVerMap {
-					if err := f(name, version, depName, depVersion, &pkg); err != nil {
-						return err
-					}
+			for depKey, pkg := range depPkgMap {
+				if err := f(name, version, depKey, &pkg); err != nil {
+					return err
 				}
 			}
 		}
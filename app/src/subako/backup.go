@@ -0,0 +1,433 @@
+package subako
+
+import (
+	"log"
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"database/sql"
+)
+
+
+const backupFormatVersion = 1
+const backupManifestName = "manifest.json"
+const backupDatabaseName = "db.sqlite"
+const aptRepositoryLockName = "apt_repository/db/lockfile"		// the lock of reprepro
+
+type BackupOptions struct {
+	AptMetadataOnly		bool		// pool of the apt repository is not included
+	ConfigSetsDir		string		// to record the revision of config sets
+}
+
+type BackupFile struct {
+	Path		string		`json:"path"`
+	Size		int64		`json:"size"`
+	SHA256		string		`json:"sha256"`
+}
+
+type BackupManifest struct {
+	FormatVersion		int				`json:"format_version"`
+	CreatedAt			time.Time		`json:"created_at"`
+	ConfigRevision		string			`json:"config_revision"`
+	AptMetadataOnly		bool			`json:"apt_metadata_only"`
+	Roots				[]string		`json:"roots"`		// paths in the storage dir which are replaced by the restore
+	Files				[]BackupFile	`json:"files"`
+}
+
+// backupRoots returns paths to be saved. The database holds available packages, profiles and tasks.
+func backupRoots(storageDir string, aptMetadataOnly bool) []string {
+	candidates := []string{
+		backupDatabaseName,
+		"queued_tasks.json",
+		"config_sets_ref.json",
+	}
+	if aptMetadataOnly {
+		candidates = append(candidates, "apt_repository/conf", "apt_repository/db", "apt_repository/dists")
+	} else {
+		candidates = append(candidates, "apt_repository")
+	}
+
+	roots := make([]string, 0, len(candidates))
+	for _, root := range candidates {
+		if Exists(filepath.Join(storageDir, root)) {
+			roots = append(roots, root)
+		}
+	}
+
+	return roots
+}
+
+// CreateBackup writes states in the storage dir as a tar.gz archive.
+// The manifest is written at the end of the archive with checksums of all files.
+// It can run while the server is running: the database is saved from a snapshot made by SQLite,
+// and the apt repository is locked in the same way as reprepro while it is archived.
+func CreateBackup(w io.Writer, storageDir string, opts *BackupOptions) (*BackupManifest, error) {
+	manifest := &BackupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt: time.Now(),
+		ConfigRevision: ConfigRevision(opts.ConfigSetsDir),
+		AptMetadataOnly: opts.AptMetadataOnly,
+		Roots: backupRoots(storageDir, opts.AptMetadataOnly),
+		Files: make([]BackupFile, 0),
+	}
+	if len(manifest.Roots) == 0 {
+		return nil, fmt.Errorf("There are no states in %s", storageDir)
+	}
+
+	if Exists(filepath.Join(storageDir, "apt_repository", "db")) {
+		unlock, err := lockAptRepository(storageDir)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, root := range manifest.Roots {
+		if err := filepath.Walk(filepath.Join(storageDir, root), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil		// directories are made by the restore
+			}
+
+			rel, err := filepath.Rel(storageDir, path)
+			if err != nil {
+				return err
+			}
+			switch filepath.ToSlash(rel) {
+			case aptRepositoryLockName:
+				return nil		// taken by this backup
+
+			case backupDatabaseName:
+				// the live file can be torn if the server is writing to it
+				snapshotPath, err := snapshotDatabase(path)
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(filepath.Dir(snapshotPath))
+
+				path = snapshotPath
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+			}
+
+			file, err := addBackupFile(tw, path, filepath.ToSlash(rel), info)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, *file)
+
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	buffer, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name: backupManifestName,
+		Mode: 0644,
+		Size: int64(len(buffer)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(buffer); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// snapshotDatabase makes a consistent copy of the database in a temporary directory
+func snapshotDatabase(path string) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "subako-backup-")
+	if err != nil {
+		return "", err
+	}
+	snapshotPath := filepath.Join(tmpDir, backupDatabaseName)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("VACUUM INTO ?", snapshotPath); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf("Failed to snapshot the database: %v", err)
+	}
+
+	return snapshotPath, nil
+}
+
+// lockAptRepository takes the lock file of reprepro, so that the repository is not changed while it is archived.
+// reprepro run by the server waits for the lock (--waitforlock).
+func lockAptRepository(storageDir string) (func(), error) {
+	path := filepath.Join(storageDir, filepath.FromSlash(aptRepositoryLockName))
+	f, err := os.OpenFile(path, os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("The apt repository is locked (%s), retry later", path)
+		}
+		return nil, err
+	}
+	f.Close()
+
+	return func() {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to unlock the apt repository: %v", err)
+		}
+	}, nil
+}
+
+func addBackupFile(tw *tar.Writer, path, name string, info os.FileInfo) (*BackupFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tw, h), f)
+	if err != nil {
+		return nil, err
+	}
+	if size != info.Size() {
+		return nil, fmt.Errorf("%s was changed during the backup", name)
+	}
+
+	return &BackupFile{
+		Path: name,
+		Size: size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// RestoreBackup extracts the archive and verifies it, then replaces states in the storage dir.
+// Replaced files are moved to the returned directory. Subako must be stopped while restoring.
+func RestoreBackup(archivePath, storageDir string) (*BackupManifest, string, error) {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(storageDir), ".subako-restore-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manifest, err := extractBackup(archivePath, tmpDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("Broken archive: %v", err)
+	}
+
+	// nothing has been changed until here
+	oldDir := fmt.Sprintf("%s.before-restore-%s", storageDir, time.Now().Format("20060102-150405"))
+	for _, root := range manifest.Roots {
+		dst := filepath.Join(storageDir, root)
+		if Exists(dst) {
+			moved := filepath.Join(oldDir, root)
+			if err := os.MkdirAll(filepath.Dir(moved), 0755); err != nil {
+				return nil, oldDir, err
+			}
+			if err := os.Rename(dst, moved); err != nil {
+				return nil, oldDir, err
+			}
+		}
+
+		src := filepath.Join(tmpDir, root)
+		if !Exists(src) {
+			// the directory was empty
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return nil, oldDir, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, oldDir, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return nil, oldDir, err
+		}
+		log.Printf("Restored => %s", root)
+	}
+
+	return manifest, oldDir, nil
+}
+
+func extractBackup(archivePath, dir string) (*BackupManifest, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	var manifest *BackupManifest
+	extracted := make(map[string]BackupFile)
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.ToSlash(filepath.Clean(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid path %s", header.Name)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("%s is not a regular file", header.Name)
+		}
+
+		if name == backupManifestName {
+			var m BackupManifest
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return nil, fmt.Errorf("manifest: %v", err)
+			}
+			manifest = &m
+			continue
+		}
+
+		file, err := extractBackupFile(tr, filepath.Join(dir, filepath.FromSlash(name)), os.FileMode(header.Mode))
+		if err != nil {
+			return nil, err
+		}
+		file.Path = name
+		extracted[name] = *file
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%s is not found", backupManifestName)
+	}
+	if err := manifest.verify(extracted); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func extractBackupFile(r io.Reader, path string, mode os.FileMode) (*BackupFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE | os.O_EXCL | os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupFile{
+		Size: size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// verify checks that extracted files are exactly same as files in the manifest
+func (m *BackupManifest) verify(extracted map[string]BackupFile) error {
+	if m.FormatVersion != backupFormatVersion {
+		return fmt.Errorf("unsupported format version %d", m.FormatVersion)
+	}
+	if len(m.Roots) == 0 {
+		return fmt.Errorf("there are no roots in the manifest")
+	}
+
+	for _, file := range m.Files {
+		e, ok := extracted[file.Path]
+		if !ok {
+			return fmt.Errorf("%s is missing", file.Path)
+		}
+		if e.Size != file.Size || e.SHA256 != file.SHA256 {
+			return fmt.Errorf("checksum mismatch: %s", file.Path)
+		}
+
+		if !m.hasRoot(file.Path) {
+			return fmt.Errorf("%s is not in roots", file.Path)
+		}
+	}
+	if len(extracted) != len(m.Files) {
+		return fmt.Errorf("the archive has files which are not in the manifest")
+	}
+
+	for _, root := range m.Roots {
+		clean := filepath.ToSlash(filepath.Clean(root))
+		if clean != root || filepath.IsAbs(root) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("invalid root %s", root)
+		}
+	}
+
+	return nil
+}
+
+func (m *BackupManifest) hasRoot(path string) bool {
+	for _, root := range m.Roots {
+		if path == root || strings.HasPrefix(path, root + "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConfigRevision returns the commit hash of config sets (empty if it is not a git repository)
+func ConfigRevision(configSetsDir string) string {
+	if configSetsDir == "" {
+		return ""
+	}
+
+	g := &gitRepository{
+		BaseDir: configSetsDir,
+	}
+	if err := g.GetRevision(); err != nil {
+		return ""	// not a git repository
+	}
+
+	return strings.TrimSpace(g.Revision)
+}
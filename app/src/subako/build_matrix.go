@@ -0,0 +1,201 @@
+package subako
+
+import (
+	"fmt"
+	"log"
+)
+
+
+// status of a cell in the build matrix
+const (
+	MatrixBuilt = "built"
+	MatrixQueued = "queued"
+	MatrixRunning = "running"
+	MatrixFailed = "failed"
+	MatrixMissing = "missing"
+	MatrixUnavailable = "unavailable"	// dependencies have not been built
+)
+
+// BuildMatrix is all combinations of versions and dependency tuples of a package
+type BuildMatrix struct {
+	Name			PackageName
+	Columns			[]DepTuple		// one empty tuple if the package has no deps
+	Rows			[]*BuildMatrixRow
+}
+
+type BuildMatrixRow struct {
+	Version			PackageVersion
+	Cells			[]*BuildMatrixCell		// same order as Columns
+}
+
+type BuildMatrixCell struct {
+	Version			PackageVersion
+	Deps			DepTuple
+	Status			string
+	Package			*AvailablePackage	// nil if not built
+	Task			*RunningTask		// the last task of the cell (can be nil)
+}
+
+func (c *BuildMatrixCell) DepKey() string {
+	return c.Deps.Key()
+}
+
+// BuildMatrixFilter selects cells to be queued. Empty lists select all.
+type BuildMatrixFilter struct {
+	Versions		[]PackageVersion
+	DepKeys			[]string
+	Force			bool		// queue cells which have been built
+}
+
+func (f *BuildMatrixFilter) selects(c *BuildMatrixCell) bool {
+	if len(f.Versions) > 0 {
+		found := false
+		for _, v := range f.Versions {
+			if v == c.Version {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.DepKeys) > 0 {
+		found := false
+		for _, k := range f.DepKeys {
+			if k == c.DepKey() {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// BuildMatrixResult is counts of cells by what queueing did
+type BuildMatrixResult struct {
+	Queued			[]string	// target IDs
+	SkippedBuilt	int
+	SkippedQueued	int
+	Unavailable		int
+}
+
+
+// MakeBuildMatrix returns the current status of all combinations of the package
+func (ctx *SubakoContext) MakeBuildMatrix(name string) (*BuildMatrix, error) {
+	snapshot := ctx.ProcConfigSetsCtx.Snapshot()
+	set, ok := snapshot.Map[PackageName(name)]
+	if !ok {
+		return nil, fmt.Errorf("There are no proc profiles for %s", name)
+	}
+
+	columns := set.DepTuples()
+	if len(columns) == 0 {
+		columns = []DepTuple{nil}
+	}
+
+	m := &BuildMatrix{
+		Name: set.Name,
+		Columns: columns,
+		Rows: make([]*BuildMatrixRow, 0),
+	}
+	for _, config := range set.SortedConfigs() {
+		row := &BuildMatrixRow{
+			Version: config.GetVersion(),
+			Cells: make([]*BuildMatrixCell, 0, len(columns)),
+		}
+		for _, deps := range columns {
+			row.Cells = append(row.Cells, ctx.makeBuildMatrixCell(snapshot, set.Name, config.GetVersion(), deps))
+		}
+		m.Rows = append(m.Rows, row)
+	}
+
+	return m, nil
+}
+
+func (ctx *SubakoContext) makeBuildMatrixCell(
+	snapshot		*ProcConfigSnapshot,
+	name			PackageName,
+	version			PackageVersion,
+	deps			DepTuple,
+) *BuildMatrixCell {
+	cell := &BuildMatrixCell{
+		Version: version,
+		Deps: deps,
+		Task: ctx.RunningTasks.LatestByTarget(name, version, deps.Key()),
+	}
+
+	if ap, err := ctx.AvailablePackages.FindDep(name, version, deps.Key()); err == nil {
+		cell.Package = ap
+	}
+
+	switch {
+	case cell.Task != nil && cell.Task.IsActive():
+		cell.Status = MatrixRunning
+	case ctx.isQueuedTarget(QueueTaskKey{Name: name, Version: version, DepKey: deps.Key()}):
+		cell.Status = MatrixQueued
+	case cell.Package != nil:
+		cell.Status = MatrixBuilt
+	case cell.Task != nil && (cell.Task.Status == TaskFailed || cell.Task.Status == TaskAborted):
+		cell.Status = MatrixFailed
+	default:
+		if _, err := snapshot.FindBuildConfig(string(name), string(version), deps.Key(), ctx.AvailablePackages); err != nil {
+			cell.Status = MatrixUnavailable
+		} else {
+			cell.Status = MatrixMissing
+		}
+	}
+
+	return cell
+}
+
+// QueueBuildMatrix queues cells of the matrix which are selected by the filter.
+// Cells which have been built are skipped unless the filter forces them, and queued cells are never queued again.
+func (ctx *SubakoContext) QueueBuildMatrix(name string, filter *BuildMatrixFilter) (*BuildMatrixResult, error) {
+	m, err := ctx.MakeBuildMatrix(name)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := ctx.ProcConfigSetsCtx.Snapshot()
+	result := &BuildMatrixResult{
+		Queued: make([]string, 0),
+	}
+	for _, row := range m.Rows {
+		for _, cell := range row.Cells {
+			if !filter.selects(cell) {
+				continue
+			}
+
+			switch cell.Status {
+			case MatrixQueued, MatrixRunning:
+				result.SkippedQueued++
+				continue
+			case MatrixBuilt:
+				if !filter.Force {
+					result.SkippedBuilt++
+					continue
+				}
+			}
+
+			procConfig, err := snapshot.FindBuildConfig(name, string(cell.Version), cell.DepKey(), ctx.AvailablePackages)
+			if err != nil {
+				log.Printf("Matrix: skip (%s, %s) with (%s) / %v", name, cell.Version, cell.DepKey(), err)
+				result.Unavailable++
+				continue
+			}
+
+			if err := ctx.Queue(procConfig); err != nil {
+				return result, err
+			}
+			result.Queued = append(result.Queued, BuildConfigTargetID(procConfig))
+		}
+	}
+
+	ctx.Logger.Succeeded(fmt.Sprintf("QueueBuildMatrix: %s (queued %d)", name, len(result.Queued)))
+
+	return result, nil
+}
@@ -17,6 +17,7 @@ import (
 
 
 const endpoint = "unix:///var/run/docker.sock"
+const builderImageName = "torigoya_builder/base"
 
 
 type BuilderConfig struct {
@@ -92,6 +93,7 @@ type IntermediateContainerInfo struct {
 func (ctx *BuilderContext) build(
 	procConfig			IPackageBuildConfig,
 	procConfigSetsDir	string,
+	sourceCommit		string,
 	writePipe			io.Writer,
 	intermediateCh		chan<-IntermediateContainerInfo,
 ) (*BuildResult, error) {
@@ -115,7 +117,7 @@ func (ctx *BuilderContext) build(
 
 	containerOpt := docker.CreateContainerOptions{
 		Config: &docker.Config{
-			Image: "torigoya_builder/base",
+			Image: builderImageName,
 			//AttachStdin:  true,
 			AttachStdout: true,
 			AttachStderr: true,
@@ -137,9 +139,10 @@ func (ctx *BuilderContext) build(
 			Cmd: []string{"bash", inContainerInstallScriptPath},
 		},
 	}
-	log.Printf("Build (%s, %s) <- %v", procConfig.GetName(), procConfig.GetDepVersion(), procConfig.GetDepPackage())
-	if procConfig.GetDepPackage() != nil {
-		ap := procConfig.GetDepPackage()
+	log.Printf("Build (%s, %s) <- %s", procConfig.GetName(), procConfig.GetVersion(), procConfig.GetDeps().Key())
+	if deps := procConfig.GetDepPackages(); len(deps) > 0 {
+		// TR_DEP_PKG_* are the first dependency, TR_DEP_<i>_* are all dependencies from 0
+		ap := deps[0]
 		containerOpt.Config.Env = append(containerOpt.Config.Env, []string{
 			"TR_DEP_PKG_NAME=" + string(ap.Name),
 			"TR_DEP_PKG_VERSION=" + string(ap.Version),
@@ -147,7 +150,22 @@ func (ctx *BuilderContext) build(
 			"TR_DEP_PKG_GEN_VERSION=" + ap.GeneratedPackageVersion,
 			"TR_DEP_PKG_DISP_VERSION=" + ap.DisplayVersion,
 			"TR_DEP_PKG_PATH=" + ap.InstallPrefix,
+			fmt.Sprintf("TR_DEP_COUNT=%d", len(deps)),
 		}...)
+		for i, ap := range deps {
+			prefix := fmt.Sprintf("TR_DEP_%d_", i)
+			containerOpt.Config.Env = append(containerOpt.Config.Env, []string{
+				prefix + "NAME=" + string(ap.Name),
+				prefix + "VERSION=" + string(ap.Version),
+				prefix + "GEN_NAME=" + ap.GeneratedPackageName,
+				prefix + "GEN_VERSION=" + ap.GeneratedPackageVersion,
+				prefix + "DISP_VERSION=" + ap.DisplayVersion,
+				prefix + "PATH=" + ap.InstallPrefix,
+			}...)
+		}
+	}
+	if sourceCommit != "" {
+		containerOpt.Config.Env = append(containerOpt.Config.Env, "TR_SOURCE_COMMIT=" + sourceCommit)
 	}
 
 	container, err := ctx.client.CreateContainer(containerOpt)
@@ -161,29 +179,10 @@ func (ctx *BuilderContext) build(
 	})
 	intermediateCh <- IntermediateContainerInfo{
 		ContainerID: container.ID,
-		KillContainerFunc: func() error {
-			log.Printf("Kill Container %s", container.ID)
-			return ctx.client.KillContainer(docker.KillContainerOptions{
-				ID: container.ID,
-			})
-		},
+		KillContainerFunc: ctx.makeKillContainerFunc(container.ID),
 	}
 
-	log.Printf("Attach Container => %s\n", container.ID)
-	attachOpt := docker.AttachToContainerOptions{
-		Container: container.ID,
-		OutputStream: writePipe,
-		ErrorStream: writePipe,
-		Logs: true,
-		Stream: true,
-		Stdout: true,
-		Stderr: true,
-	}
-	go func(ctx *BuilderContext, opt docker.AttachToContainerOptions) {
-		if err := ctx.client.AttachToContainer(opt); err != nil {
-			log.Printf("Error: AttachToContainer: %v\n", err)
-		}
-	}(ctx, attachOpt)
+	ctx.attach(container.ID, writePipe)
 
 	log.Printf("Start Container\n")
 	startT := time.Now()
@@ -201,7 +200,70 @@ func (ctx *BuilderContext) build(
 		return nil, err
 	}
 
-	status_code, err := ctx.client.WaitContainer(container.ID)
+	return ctx.waitResult(container.ID, procConfig, writePipe, startT)
+}
+
+// reattach waits for the container which was started before the restart of Subako
+func (ctx *BuilderContext) reattach(
+	containerID			string,
+	procConfig			IPackageBuildConfig,
+	writePipe			io.Writer,
+) (*BuildResult, error) {
+	container, err := ctx.client.InspectContainer(containerID)
+	if err != nil {
+		log.Printf("Error: InspectContainer: %v\n", err)
+		return nil, err
+	}
+	defer ctx.client.RemoveContainer(docker.RemoveContainerOptions{
+		ID: container.ID,
+		Force: true,
+	})
+
+	// all logs are written again from the beginning
+	ctx.attach(container.ID, writePipe)
+
+	return ctx.waitResult(container.ID, procConfig, writePipe, container.State.StartedAt)
+}
+
+func (ctx *BuilderContext) containerExists(containerID string) bool {
+	_, err := ctx.client.InspectContainer(containerID)
+	return err == nil
+}
+
+func (ctx *BuilderContext) makeKillContainerFunc(containerID string) func() error {
+	return func() error {
+		log.Printf("Kill Container %s", containerID)
+		return ctx.client.KillContainer(docker.KillContainerOptions{
+			ID: containerID,
+		})
+	}
+}
+
+func (ctx *BuilderContext) attach(containerID string, writePipe io.Writer) {
+	log.Printf("Attach Container => %s\n", containerID)
+	attachOpt := docker.AttachToContainerOptions{
+		Container: containerID,
+		OutputStream: writePipe,
+		ErrorStream: writePipe,
+		Logs: true,
+		Stream: true,
+		Stdout: true,
+		Stderr: true,
+	}
+	go func(ctx *BuilderContext, opt docker.AttachToContainerOptions) {
+		if err := ctx.client.AttachToContainer(opt); err != nil {
+			log.Printf("Error: AttachToContainer: %v\n", err)
+		}
+	}(ctx, attachOpt)
+}
+
+func (ctx *BuilderContext) waitResult(
+	containerID			string,
+	procConfig			IPackageBuildConfig,
+	writePipe			io.Writer,
+	startT				time.Time,
+) (*BuildResult, error) {
+	status_code, err := ctx.client.WaitContainer(containerID)
 	log.Printf("status_code = %d / %v\n", status_code, err)
 	if err != nil {
 		return nil, err
@@ -226,7 +288,7 @@ func (ctx *BuilderContext) build(
         return nil, err
 	}
 	br.hostInstallBase = ctx.installBasePrefix			//
-	br.hostInstallPrefix = inContainerInstalledPath		//
+	br.hostInstallPrefix = path.Join(ctx.installBasePrefix, procConfig.makePackagePathName())
 	br.duration = endT.Sub(startT)
 
 	log.Println("BUILD RESULT", br)
@@ -0,0 +1,92 @@
+package subako
+
+import (
+	"fmt"
+	"strings"
+)
+
+
+// ConfigError is a problem in config sets
+type ConfigError struct {
+	Path		string		`json:"path"`
+	Field		string		`json:"field"`
+	Reason		string		`json:"reason"`
+}
+
+func (e *ConfigError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", e.Path, e.Field, e.Reason)
+}
+
+// ConfigErrors collects all problems instead of stopping at the first one
+type ConfigErrors []*ConfigError
+
+func (es ConfigErrors) Error() string {
+	lines := make([]string, len(es))
+	for i, e := range es {
+		lines[i] = e.Error()
+	}
+
+	return fmt.Sprintf("%d error(s) in config sets:\n%s", len(es), strings.Join(lines, "\n"))
+}
+
+func (es *ConfigErrors) add(path, field, reason string, args ...interface{}) {
+	*es = append(*es, &ConfigError{
+		Path: path,
+		Field: field,
+		Reason: fmt.Sprintf(reason, args...),
+	})
+}
+
+// addError appends the error. ConfigErrors are appended as they are.
+func (es *ConfigErrors) addError(path string, err error) {
+	if inner := AsConfigErrors(err); inner != nil {
+		*es = append(*es, inner...)
+		return
+	}
+
+	es.add(path, "", "%v", err)
+}
+
+// AsConfigErrors returns problems in config sets if the error has them
+func AsConfigErrors(err error) ConfigErrors {
+	if es, ok := err.(ConfigErrors); ok {
+		return es
+	}
+
+	return nil
+}
+
+
+// checkConfigVersion checks that the version can be used in paths, package names and URLs
+func checkConfigVersion(version string) string {
+	if version == "" {
+		return "must not be empty"
+	}
+	if strings.ContainsAny(version, "/\\ \t\n") {
+		return "must not contain '/', '\\' or spaces"
+	}
+	if version == "." || version == ".." {
+		return "must not be '.' or '..'"
+	}
+
+	return ""
+}
+
+// checkConfigName checks that the name can be used in paths, package names and URLs
+func checkConfigName(name string) string {
+	if name == "" {
+		return "must not be empty"
+	}
+	if strings.ContainsAny(name, "/\\ \t\n") {
+		return "must not contain '/', '\\' or spaces"
+	}
+	if strings.HasPrefix(name, ".") {
+		return "must not start with '.'"
+	}
+
+	return ""
+}
@@ -0,0 +1,119 @@
+package subako
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+
+// keys of package_config.json which list slots or are used out of builds.
+// Adding a version must not change fingerprints of versions which have been built.
+var fingerprintExcludedKeys = []string{"versions", "dep_pkgs", "aliases", "queue_with", "auto_rebuild", "source"}
+
+// fingerprintConfigDir returns the hash of files which are used to build the package.
+// Language configs in the dir are excluded, because they only affect profiles.
+// Inputs of each version are added by fingerprintVersion.
+func fingerprintConfigDir(baseDir string, langConfigPaths []targetPath) (string, error) {
+	excluded := make(map[string]bool)
+	for _, p := range langConfigPaths {
+		excluded[filepath.Clean(string(p))] = true
+	}
+
+	h := sha256.New()
+	if err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if excluded[filepath.Clean(path)] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+
+		var sum string
+		if rel == "package_config.json" {
+			sum, err = hashPackageConfig(path)
+		} else {
+			sum, err = hashFile(path)
+		}
+		if err != nil {
+			return err
+		}
+		// the executable bit affects scripts in builds
+		fmt.Fprintf(h, "%s\x00%v\x00%s\n", filepath.ToSlash(rel), info.Mode().Perm() & 0111 != 0, sum)
+
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintVersion adds inputs which differ between versions to the fingerprint of the dir
+func fingerprintVersion(dirFingerprint string, source *PackageSource) string {
+	if source == nil {
+		return dirFingerprint
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\n", dirFingerprint, source.Git, source.ref())
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashPackageConfig hashes the package config without fingerprintExcludedKeys
+func hashPackageConfig(path string) (string, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(file, &doc); err != nil {
+		return "", err
+	}
+	for _, key := range fingerprintExcludedKeys {
+		delete(doc, key)
+	}
+
+	normalized, err := json.Marshal(doc)		// keys are sorted
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(normalized)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,402 @@
+package subako
+
+import (
+	"log"
+	"sort"
+	"path/filepath"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+)
+
+
+// ConfigSnapshot is a summary of loaded config sets to compare revisions
+type ConfigSnapshot map[PackageName]*PackageSnapshot
+
+type PackageSnapshot struct {
+	Versions		[]PackageVersion					`json:"versions"`
+	QueueWith		[]PackageName						`json:"queue_with"`
+	DepPkgs			map[PackageName][]PackageVersion	`json:"dep_pkgs"`
+	Deps			[]DepRequirement					`json:"deps,omitempty"`
+	Langs			map[LanguageName]*LangSnapshot		`json:"langs"`
+}
+
+type LangSnapshot struct {
+	Versions		[]LanguageVersion	`json:"versions"`
+	Template		string				`json:"template"`		// hash of the profile template
+	Patches			map[string]string	`json:"patches"`		// file name => hash of the patch
+}
+
+// ConfigDiff is changes from the previous revision
+type ConfigDiff struct {
+	AddedPackages		[]PackageName		`json:"added_packages"`
+	RemovedPackages		[]PackageName		`json:"removed_packages"`
+	ChangedPackages		[]*PackageDiff		`json:"changed_packages"`
+}
+
+type PackageDiff struct {
+	Name				PackageName			`json:"name"`
+	AddedVersions		[]string			`json:"added_versions"`
+	RemovedVersions		[]string			`json:"removed_versions"`
+	AddedDepPkgs		[]string			`json:"added_dep_pkgs"`		// name/version
+	RemovedDepPkgs		[]string			`json:"removed_dep_pkgs"`
+	AddedQueueWith		[]string			`json:"added_queue_with"`
+	RemovedQueueWith	[]string			`json:"removed_queue_with"`
+	AddedLangs			[]string			`json:"added_langs"`
+	RemovedLangs		[]string			`json:"removed_langs"`
+	ChangedLangs		[]*LangDiff			`json:"changed_langs"`
+}
+
+type LangDiff struct {
+	Name				LanguageName		`json:"name"`
+	AddedVersions		[]string			`json:"added_versions"`
+	RemovedVersions		[]string			`json:"removed_versions"`
+	TemplateChanged		bool				`json:"template_changed"`
+	AddedPatches		[]string			`json:"added_patches"`
+	RemovedPatches		[]string			`json:"removed_patches"`
+	ChangedPatches		[]string			`json:"changed_patches"`
+}
+
+func (d *ConfigDiff) IsEmpty() bool {
+	return len(d.AddedPackages) == 0 && len(d.RemovedPackages) == 0 && len(d.ChangedPackages) == 0
+}
+
+
+// ConfigHistory is a loaded revision of config sets
+type ConfigHistory struct {
+	gorm.Model
+	Revision	string		// empty if config sets are not a git repository
+	Ref			string
+	Snapshot	string		`sql:"type:text"`	// JSON of ConfigSnapshot
+	Diff		string		`sql:"type:text"`	// JSON of ConfigDiff
+}
+
+func (h *ConfigHistory) GetDiff() *ConfigDiff {
+	var diff ConfigDiff
+	if err := json.Unmarshal([]byte(h.Diff), &diff); err != nil {
+		log.Printf("Broken diff of config history %d: %v", h.ID, err)
+	}
+
+	return &diff
+}
+
+func (h *ConfigHistory) getSnapshot() ConfigSnapshot {
+	snapshot := make(ConfigSnapshot)
+	if err := json.Unmarshal([]byte(h.Snapshot), &snapshot); err != nil {
+		log.Printf("Broken snapshot of config history %d: %v", h.ID, err)
+	}
+
+	return snapshot
+}
+
+
+type ConfigHistoryContext struct {
+	Db		gorm.DB
+}
+
+func MakeConfigHistoryContext(db gorm.DB) (*ConfigHistoryContext, error) {
+	db.AutoMigrate(&ConfigHistory{})
+
+	return &ConfigHistoryContext{
+		Db: db,
+	}, nil
+}
+
+// Latest returns the last loaded revision. nil is returned if nothing has been recorded.
+func (ctx *ConfigHistoryContext) Latest() (*ConfigHistory, error) {
+	var h ConfigHistory
+	if err := ctx.Db.Debug().Order("id desc").First(&h).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+func (ctx *ConfigHistoryContext) Get(id uint) (*ConfigHistory, error) {
+	var h ConfigHistory
+	if err := ctx.Db.Debug().First(&h, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+func (ctx *ConfigHistoryContext) Find(limit int) []ConfigHistory {
+	histories := []ConfigHistory{}
+	ctx.Db.Debug().Order("id desc").Limit(limit).Find(&histories)
+
+	return histories
+}
+
+// Record appends the loaded config sets with the diff from the latest one.
+// Nothing is appended if neither the revision nor the config sets are changed.
+func (ctx *ConfigHistoryContext) Record(revision, ref string, m ProcConfigMap) (*ConfigHistory, error) {
+	snapshot := makeConfigSnapshot(m)
+
+	prev := make(ConfigSnapshot)
+	latest, err := ctx.Latest()
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil {
+		prev = latest.getSnapshot()
+	}
+
+	diff := diffConfigSnapshots(prev, snapshot)
+	if latest != nil && latest.Revision == revision && diff.IsEmpty() {
+		return latest, nil
+	}
+
+	snapshotBuf, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	diffBuf, err := json.Marshal(diff)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ConfigHistory{
+		Revision: revision,
+		Ref: ref,
+		Snapshot: string(snapshotBuf),
+		Diff: string(diffBuf),
+	}
+	if err := ctx.Db.Debug().Create(h).Error; err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+
+func makeConfigSnapshot(m ProcConfigMap) ConfigSnapshot {
+	snapshot := make(ConfigSnapshot)
+	for name, set := range m {
+		ps := &PackageSnapshot{
+			Versions: set.Versions,
+			QueueWith: set.QueueWith,
+			DepPkgs: set.DepPkgs,
+			Deps: set.Deps,
+			Langs: make(map[LanguageName]*LangSnapshot),
+		}
+
+		for langName, lc := range set.LangConfigs {
+			ls := &LangSnapshot{
+				Versions: lc.Versions,
+				Patches: make(map[string]string),
+			}
+			if lc.ProfileTemplate != nil {
+				ls.Template = hashOf(lc.ProfileTemplate)
+			}
+			for _, patch := range lc.ProfilePatches {
+				ls.Patches[filepath.Base(patch.filePath)] = hashOf(patch)
+			}
+
+			ps.Langs[langName] = ls
+		}
+
+		snapshot[name] = ps
+	}
+
+	return snapshot
+}
+
+// hashOf returns the hash of the loaded value, so that changes of only spaces or comments are ignored
+func hashOf(v interface{}) string {
+	buffer, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(buffer)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func diffConfigSnapshots(prev, next ConfigSnapshot) *ConfigDiff {
+	diff := &ConfigDiff{
+		AddedPackages: make([]PackageName, 0),
+		RemovedPackages: make([]PackageName, 0),
+		ChangedPackages: make([]*PackageDiff, 0),
+	}
+
+	for _, name := range unionKeys(prev, next) {
+		name := PackageName(name)
+		p, inPrev := prev[name]
+		n, inNext := next[name]
+
+		switch {
+		case !inPrev:
+			diff.AddedPackages = append(diff.AddedPackages, name)
+		case !inNext:
+			diff.RemovedPackages = append(diff.RemovedPackages, name)
+		default:
+			if pd := diffPackageSnapshots(name, p, n); pd != nil {
+				diff.ChangedPackages = append(diff.ChangedPackages, pd)
+			}
+		}
+	}
+
+	return diff
+}
+
+func diffPackageSnapshots(name PackageName, p, n *PackageSnapshot) *PackageDiff {
+	d := &PackageDiff{
+		Name: name,
+	}
+
+	d.AddedVersions, d.RemovedVersions = diffStrings(toStrings(p.Versions), toStrings(n.Versions))
+	d.AddedDepPkgs, d.RemovedDepPkgs = diffStrings(
+		append(depPkgStrings(p.DepPkgs), depRequirementStrings(p.Deps)...),
+		append(depPkgStrings(n.DepPkgs), depRequirementStrings(n.Deps)...),
+	)
+	d.AddedQueueWith, d.RemovedQueueWith = diffStrings(toStrings(p.QueueWith), toStrings(n.QueueWith))
+
+	for _, langName := range unionKeys(p.Langs, n.Langs) {
+		pl, inPrev := p.Langs[LanguageName(langName)]
+		nl, inNext := n.Langs[LanguageName(langName)]
+
+		switch {
+		case !inPrev:
+			d.AddedLangs = append(d.AddedLangs, langName)
+		case !inNext:
+			d.RemovedLangs = append(d.RemovedLangs, langName)
+		default:
+			if ld := diffLangSnapshots(LanguageName(langName), pl, nl); ld != nil {
+				d.ChangedLangs = append(d.ChangedLangs, ld)
+			}
+		}
+	}
+
+	if len(d.AddedVersions) == 0 && len(d.RemovedVersions) == 0 &&
+		len(d.AddedDepPkgs) == 0 && len(d.RemovedDepPkgs) == 0 &&
+		len(d.AddedQueueWith) == 0 && len(d.RemovedQueueWith) == 0 &&
+		len(d.AddedLangs) == 0 && len(d.RemovedLangs) == 0 && len(d.ChangedLangs) == 0 {
+		return nil
+	}
+
+	return d
+}
+
+func diffLangSnapshots(name LanguageName, p, n *LangSnapshot) *LangDiff {
+	d := &LangDiff{
+		Name: name,
+		TemplateChanged: p.Template != n.Template,
+	}
+
+	d.AddedVersions, d.RemovedVersions = diffStrings(toStrings(p.Versions), toStrings(n.Versions))
+	for _, fileName := range unionKeys(p.Patches, n.Patches) {
+		prevHash, inPrev := p.Patches[fileName]
+		nextHash, inNext := n.Patches[fileName]
+
+		switch {
+		case !inPrev:
+			d.AddedPatches = append(d.AddedPatches, fileName)
+		case !inNext:
+			d.RemovedPatches = append(d.RemovedPatches, fileName)
+		case prevHash != nextHash:
+			d.ChangedPatches = append(d.ChangedPatches, fileName)
+		}
+	}
+
+	if len(d.AddedVersions) == 0 && len(d.RemovedVersions) == 0 && !d.TemplateChanged &&
+		len(d.AddedPatches) == 0 && len(d.RemovedPatches) == 0 && len(d.ChangedPatches) == 0 {
+		return nil
+	}
+
+	return d
+}
+
+
+// diffStrings returns values which are only in next, and values which are only in prev
+func diffStrings(prev, next []string) (added, removed []string) {
+	inPrev := make(map[string]bool)
+	for _, v := range prev {
+		inPrev[v] = true
+	}
+	inNext := make(map[string]bool)
+	for _, v := range next {
+		inNext[v] = true
+	}
+
+	for _, v := range next {
+		if !inPrev[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range prev {
+		if !inNext[v] {
+			removed = append(removed, v)
+		}
+	}
+
+	return
+}
+
+func depPkgStrings(depPkgs map[PackageName][]PackageVersion) []string {
+	values := make([]string, 0)
+	for name, versions := range depPkgs {
+		for _, version := range versions {
+			values = append(values, string(name) + "/" + string(version))
+		}
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+// depRequirementStrings returns name/version of deps (all of them are required at once, so they are marked with "+")
+func depRequirementStrings(reqs []DepRequirement) []string {
+	values := make([]string, 0)
+	for _, req := range reqs {
+		for _, version := range req.Versions {
+			values = append(values, "+" + string(req.Name) + "/" + string(version))
+		}
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+// toStrings converts slices of named string types
+func toStrings(values interface{}) []string {
+	result := make([]string, 0)
+	switch vs := values.(type) {
+	case []PackageVersion:
+		for _, v := range vs { result = append(result, string(v)) }
+	case []PackageName:
+		for _, v := range vs { result = append(result, string(v)) }
+	case []LanguageVersion:
+		for _, v := range vs { result = append(result, string(v)) }
+	}
+
+	return result
+}
+
+// unionKeys returns sorted keys of both maps which have string keys
+func unionKeys(a, b interface{}) []string {
+	keys := make(map[string]bool)
+	for _, m := range []interface{}{a, b} {
+		switch m := m.(type) {
+		case ConfigSnapshot:
+			for k := range m { keys[string(k)] = true }
+		case map[LanguageName]*LangSnapshot:
+			for k := range m { keys[string(k)] = true }
+		case map[string]string:
+			for k := range m { keys[k] = true }
+		}
+	}
+
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+
+	return result
+}
@@ -0,0 +1,187 @@
+package subako
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+)
+
+
+// Each snapshot of config sets has its own copy of the tree, which builds mount instead of the working tree.
+// The working tree is changed by reloads (Ex. git checkout) while tasks are queued or running.
+// A copy is removed when neither the current snapshot nor tasks refer it.
+
+// exportSnapshotDir copies config sets to a new directory in SnapshotsDir
+func (ctx *ProcConfigSetsContext) exportSnapshotDir() (string, error) {
+	if err := os.MkdirAll(ctx.SnapshotsDir, 0755); err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir(ctx.SnapshotsDir, "config-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	if err := copyConfigSets(ctx.BaseDir, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// copyConfigSets copies files, directories and symlinks with their modes. .git is not copied.
+func copyConfigSets(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == ".git" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+
+		case info.Mode() & os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+
+		return nil		// sockets and so on
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE | os.O_EXCL | os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// isSnapshotDir returns true if the dir is a copy which is managed by the context
+func (ctx *ProcConfigSetsContext) isSnapshotDir(dir string) bool {
+	return ctx.SnapshotsDir != "" && dir != "" && filepath.Dir(filepath.Clean(dir)) == filepath.Clean(ctx.SnapshotsDir)
+}
+
+func (ctx *ProcConfigSetsContext) retainDir(dir string) {
+	if !ctx.isSnapshotDir(dir) {
+		return
+	}
+
+	ctx.dirsM.Lock()
+	defer ctx.dirsM.Unlock()
+
+	ctx.dirRefs[dir]++
+}
+
+func (ctx *ProcConfigSetsContext) releaseDir(dir string) {
+	if !ctx.isSnapshotDir(dir) {
+		return
+	}
+
+	ctx.dirsM.Lock()
+	defer ctx.dirsM.Unlock()
+
+	ctx.dirRefs[dir]--
+	if ctx.dirRefs[dir] > 0 {
+		return
+	}
+	delete(ctx.dirRefs, dir)
+
+	log.Printf("Remove the config snapshot => %s", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove the config snapshot %s: %v", dir, err)
+	}
+}
+
+// AcquireSnapshot keeps the tree of the snapshot until ReleaseSnapshot is called
+func (ctx *ProcConfigSetsContext) AcquireSnapshot(s *ProcConfigSnapshot) {
+	if s != nil {
+		ctx.retainDir(s.Dir)
+	}
+}
+
+func (ctx *ProcConfigSetsContext) ReleaseSnapshot(s *ProcConfigSnapshot) {
+	if s != nil {
+		ctx.releaseDir(s.Dir)
+	}
+}
+
+// removeUnusedSnapshotDirs removes copies which were left by the previous run (Ex. tasks which were queued at the shutdown).
+// It must be called after copies which are still mounted by reattached containers are retained.
+func (ctx *ProcConfigSetsContext) removeUnusedSnapshotDirs() {
+	if ctx.SnapshotsDir == "" {
+		return
+	}
+
+	infos, err := ioutil.ReadDir(ctx.SnapshotsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to list config snapshots: %v", err)
+		}
+		return
+	}
+
+	ctx.dirsM.Lock()
+	defer ctx.dirsM.Unlock()
+
+	for _, info := range infos {
+		dir := filepath.Join(ctx.SnapshotsDir, info.Name())
+		if ctx.dirRefs[dir] > 0 {
+			continue
+		}
+
+		log.Printf("Remove the unused config snapshot => %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove the config snapshot %s: %v", dir, err)
+		}
+	}
+}
+
+// rebase replaces paths in the copy with paths in the working tree, so that problems point files which users edit
+func (es ConfigErrors) rebase(from, to string) {
+	for _, e := range es {
+		if rel, err := filepath.Rel(from, e.Path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+			e.Path = filepath.Join(to, rel)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package subako
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+
+const defaultConfigWatchDebounce = 2 * time.Second
+
+// ConfigWatcher reloads config sets when files in the dir are changed.
+// Changes are debounced so that saving many files at once causes only one reload.
+type ConfigWatcher struct {
+	baseDir			string
+	debounce		time.Duration
+	onChange		func()
+
+	watcher			*fsnotify.Watcher
+	done			chan struct{}
+}
+
+func MakeConfigWatcher(baseDir string, debounce time.Duration, onChange func()) (*ConfigWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if debounce == 0 {
+		debounce = defaultConfigWatchDebounce
+	}
+
+	w := &ConfigWatcher{
+		baseDir: baseDir,
+		debounce: debounce,
+		onChange: onChange,
+		watcher: watcher,
+		done: make(chan struct{}),
+	}
+
+	if err := w.addDirs(baseDir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// addDirs watches the dir and all dirs in it, because inotify is not recursive
+func (w *ConfigWatcher) addDirs(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != w.baseDir && isHiddenName(filepath.Base(path)) {
+			return filepath.SkipDir
+		}
+
+		return w.watcher.Add(path)
+	})
+}
+
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func (w *ConfigWatcher) run() {
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if isHiddenName(filepath.Base(event.Name)) {
+				continue	// editors' swap files and so on
+			}
+
+			// watch new dirs
+			if event.Op & fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := w.addDirs(event.Name); err != nil {
+						log.Printf("ConfigWatcher: failed to watch %s: %v", event.Name, err)
+					}
+				}
+			}
+
+			log.Printf("ConfigWatcher: %s is changed", event.Name)
+			timer = time.After(w.debounce)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("ConfigWatcher: %v", err)
+
+		case <-timer:
+			timer = nil
+			w.onChange()
+
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *ConfigWatcher) Close() error {
+	close(w.done)
+
+	return w.watcher.Close()
+}
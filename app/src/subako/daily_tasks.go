@@ -16,6 +16,13 @@ type DailyTask struct {
 	Version		string
 }
 
+func (t *DailyTask) AuditValue() map[string]string {
+	return map[string]string{
+		"proc_name": t.ProcName,
+		"version": t.Version,
+	}
+}
+
 type DailyTasksContext struct {
 	Db		gorm.DB
 	Point	Crontab
@@ -38,6 +45,15 @@ func (ctx *DailyTasksContext) GetDailyTasks() []DailyTask {
 	return tasks
 }
 
+func (ctx *DailyTasksContext) Get(id uint) (*DailyTask, error) {
+	task := DailyTask{}
+	if err := ctx.Db.Debug().First(&task, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
 func (ctx *DailyTasksContext) Append(task *DailyTask) error {
 	// TODO: error handling
 	ctx.Db.Debug().Create(task)
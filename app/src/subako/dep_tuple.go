@@ -0,0 +1,129 @@
+package subako
+
+import (
+	"fmt"
+	"strings"
+)
+
+
+// DepPackage is a built package which another package is built with
+type DepPackage struct {
+	Name		PackageName
+	Version		PackageVersion
+}
+
+// DepTuple is all packages which a build depends on. The order is the declared order in the config.
+type DepTuple []DepPackage
+
+// Key returns the identifier of the tuple (Ex. gcc/6.1.0,libstdcxx/6.1.0). It is empty if there are no deps.
+func (t DepTuple) Key() string {
+	parts := make([]string, len(t))
+	for i, d := range t {
+		parts[i] = string(d.Name) + "/" + string(d.Version)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (t DepTuple) Contains(name PackageName, version PackageVersion) bool {
+	for _, d := range t {
+		if d.Name == name && d.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDepKey is the inverse of DepTuple.Key
+func ParseDepKey(key string) (DepTuple, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	tuple := make(DepTuple, 0)
+	for _, part := range strings.Split(key, ",") {
+		i := strings.Index(part, "/")
+		if i <= 0 || i == len(part) - 1 {
+			return nil, fmt.Errorf("invalid dependency %q in %q (must be name/version)", part, key)
+		}
+		tuple = append(tuple, DepPackage{
+			Name: PackageName(part[:i]),
+			Version: PackageVersion(part[i+1:]),
+		})
+	}
+
+	return tuple, nil
+}
+
+// singleDepKey returns the key of the tuple which has only the package
+func singleDepKey(name PackageName, version PackageVersion) string {
+	if name == "" {
+		return ""
+	}
+	return DepTuple{{Name: name, Version: version}}.Key()
+}
+
+
+// DepRequirement is an element of deps in the package config.
+// A package is built with every combination of versions of all requirements.
+type DepRequirement struct {
+	Name		PackageName			`json:"name" schema:"required"`
+	Versions	[]PackageVersion	`json:"versions" schema:"required"`
+}
+
+// DepTuples returns all tuples which the package is built with.
+// Each entry of dep_pkgs is a tuple which has one package, and deps makes tuples of all combinations.
+func (pc *PackageBuildConfigSet) DepTuples() []DepTuple {
+	tuples := make([]DepTuple, 0)
+	for _, sd := range pc.SortedDepPkgs() {
+		tuples = append(tuples, DepTuple{{Name: sd.Name, Version: sd.Version}})
+	}
+
+	if len(pc.Deps) > 0 {
+		combinations := []DepTuple{{}}
+		for _, req := range pc.Deps {
+			versions := toStrings(req.Versions)
+			SortVersions(versions)
+
+			next := make([]DepTuple, 0, len(combinations) * len(versions))
+			for _, c := range combinations {
+				for _, v := range versions {
+					t := make(DepTuple, len(c), len(c) + 1)
+					copy(t, c)
+					next = append(next, append(t, DepPackage{Name: req.Name, Version: PackageVersion(v)}))
+				}
+			}
+			combinations = next
+		}
+		tuples = append(tuples, combinations...)
+	}
+
+	return tuples
+}
+
+func checkDepRequirements(reqs []DepRequirement, configPath string, errs *ConfigErrors) {
+	seen := make(map[PackageName]bool)
+	for i, req := range reqs {
+		field := fmt.Sprintf("deps[%d]", i)
+		if reason := checkConfigName(string(req.Name)); reason != "" {
+			errs.add(configPath, field + ".name", "%s", reason)
+		} else if strings.Contains(string(req.Name), ",") {
+			errs.add(configPath, field + ".name", "must not contain ','")
+		}
+		if seen[req.Name] {
+			errs.add(configPath, field + ".name", "duplicated package %q", req.Name)
+		}
+		seen[req.Name] = true
+
+		if len(req.Versions) == 0 {
+			errs.add(configPath, field + ".versions", "must have at least one version")
+		}
+		for j, version := range req.Versions {
+			if reason := checkConfigVersion(string(version)); reason != "" {
+				errs.add(configPath, fmt.Sprintf("%s.versions[%d]", field, j), "%s (%q)", reason, version)
+			} else if strings.Contains(string(version), ",") {
+				errs.add(configPath, fmt.Sprintf("%s.versions[%d]", field, j), "must not contain ','")
+			}
+		}
+	}
+}
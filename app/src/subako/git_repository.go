@@ -3,22 +3,98 @@ package subako
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"bytes"
+	"errors"
+	"strings"
+	"syscall"
+	"sync/atomic"
+	"time"
 )
 
 
+const defaultConfigSetsRef = "master"
+
 type gitRepository struct {
 	BaseDir			string
 	Url				string
+	Ref				string		// branch, tag or commit to be checked out
 
 	Revision		string
 }
 
+// runGit runs the git command in the dir without shells. The output of stderr is contained in the error.
+func runGit(dir string, args ...string) (string, error) {
+	return runGitWithTimeout(dir, 0, args...)
+}
+
+// runGitWithTimeout kills the command (and ssh which is run by it) if it does not finish in the timeout. 0 means no timeout.
+func runGitWithTimeout(dir string, timeout time.Duration, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",				// fail instead of asking credentials
+		"GIT_SSH_COMMAND=ssh -o BatchMode=yes",	// same for passphrases and host keys
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	command := "git " + strings.Join(args, " ")
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%s: %v", command, err)
+	}
+
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)		// the process group
+		})
+		defer timer.Stop()
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if atomic.LoadInt32(&timedOut) != 0 {
+			err = fmt.Errorf("timed out after %v", timeout)
+		}
+		log.Printf("Error: %s\n%s%s\n", command, stdout.String(), stderr.String())
+		return "", fmt.Errorf("%s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	log.Printf("%s\n%s%s\n", command, stdout.String(), stderr.String())
+
+	return stdout.String(), nil
+}
+
+// checkGitRef rejects refs which are interpreted as options or are not valid names
+func checkGitRef(ref string) error {
+	if ref == "" {
+		return errors.New("ref must not be empty")
+	}
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid ref %q: must not start with '-'", ref)
+	}
+	if strings.ContainsAny(ref, " \t\n~^:?*[\\") || strings.Contains(ref, "..") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+
+	return nil
+}
+
+func (g *gitRepository) ref() string {
+	if g.Ref == "" {
+		return defaultConfigSetsRef
+	}
+
+	return g.Ref
+}
+
 func (g *gitRepository) Clone() error {
-	cmd := exec.Command("git", "clone", g.Url, g.BaseDir)
-	if err := cmd.Run(); err != nil {
-		return err
+	if _, err := runGit("", "clone", "--", g.Url, g.BaseDir); err != nil {
+		return fmt.Errorf("Failed to clone config sets from %s: %v", g.Url, err)
 	}
 
 	g.GetRevision()		// no error check
@@ -26,49 +102,66 @@ func (g *gitRepository) Clone() error {
 	return nil
 }
 
+// Pull fetches the remote and checks out the ref. Local changes are discarded.
 func (g *gitRepository) Pull() error {
+	ref := g.ref()
+	if err := checkGitRef(ref); err != nil {
+		return err
+	}
 
-	if g.Revision != "" {
-		cmd := exec.Command("bash", "-c", fmt.Sprintf("cd '%s' && git reset --hard origin/master", g.BaseDir))
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &out
+	if _, err := runGit(g.BaseDir, "fetch", "--prune", "--tags", "--force", "origin"); err != nil {
+		return fmt.Errorf("Failed to fetch config sets from %s: %v", g.Url, err)
+	}
 
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error: git reset --hard origin/master\n%s\n", out.String())
-			return err
-		}
+	hash, err := g.resolve(ref)
+	if err != nil {
+		return err
+	}
 
-		log.Printf("git reset --hard origin/master\n%s\n", out.String())
+	if err := g.Checkout(hash); err != nil {
+		return err
 	}
 
-	{
-		cmd := exec.Command("bash", "-c", fmt.Sprintf("cd '%s' && git pull origin master", g.BaseDir))
+	return g.GetRevision()
+}
+
+// resolve returns the commit hash of the ref. Branches are resolved by the remote to follow it.
+func (g *gitRepository) resolve(ref string) (string, error) {
+	candidates := []string{
+		"refs/remotes/origin/" + ref,
+		"refs/tags/" + ref,
+		ref,
+	}
+	for _, candidate := range candidates {
+		cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", candidate + "^{commit}")
+		cmd.Dir = g.BaseDir
 		var out bytes.Buffer
 		cmd.Stdout = &out
-		cmd.Stderr = &out
 
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error: git pull origin master\n%s\n", out.String())
-			return err
+		if err := cmd.Run(); err == nil {
+			return strings.TrimSpace(out.String()), nil
 		}
+	}
 
-		log.Printf("git pull origin master\n%s\n", out.String())
+	return "", fmt.Errorf("%q is not a branch, tag or commit of %s", ref, g.Url)
+}
+
+// Checkout checks out the commit as detached HEAD
+func (g *gitRepository) Checkout(hash string) error {
+	if _, err := runGit(g.BaseDir, "checkout", "--quiet", "--force", "--detach", hash); err != nil {
+		return fmt.Errorf("Failed to checkout %s: %v", hash, err)
 	}
 
-	return g.GetRevision()
+	return nil
 }
 
 func (g *gitRepository) GetRevision() error {
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("cd '%s' && git rev-parse HEAD", g.BaseDir))
-	var out bytes.Buffer
-	cmd.Stdout = &out
-
-	if err := cmd.Run(); err != nil {
+	out, err := runGit(g.BaseDir, "rev-parse", "HEAD")
+	if err != nil {
 		return err
 	}
 
-	hash := out.String()
+	hash := strings.TrimSpace(out)
 	log.Printf("commit hash: %s", hash)
 
 	g.Revision = hash
@@ -0,0 +1,159 @@
+package subako
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+
+const healthCheckTimeout = 5 * time.Second
+const defaultMinFreeDiskBytes = 1024 * 1024 * 1024	// 1GiB
+
+type HealthCheckResult struct {
+	Name		string	`json:"name"`
+	OK			bool	`json:"ok"`
+	Message		string	`json:"message,omitempty"`
+	ElapsedMs	int64	`json:"elapsed_ms"`
+}
+
+type ReadinessReport struct {
+	Ready		bool				`json:"ready"`
+	Checks		[]HealthCheckResult	`json:"checks"`
+}
+
+// a row which is overwritten to check that the database is writable
+type healthProbe struct {
+	ID			uint		`gorm:"primary_key"`
+	CheckedAt	time.Time
+}
+
+type healthCheck struct {
+	name	string
+	f		func() error
+}
+
+// CheckReadiness checks that all dependencies which are required to build packages are available
+func (ctx *SubakoContext) CheckReadiness() *ReadinessReport {
+	checks := []healthCheck{
+		{"docker", ctx.BuilderCtx.Ping},
+		{"builder_image", ctx.BuilderCtx.CheckImage},
+		{"reprepro", ctx.AptRepoCtx.CheckReprepro},
+		{"database", ctx.checkDatabase},
+		{"proc_config_sets", func() error { return ctx.ProcConfigSetsCtx.LastError() }},
+		{"disk_space", ctx.checkDiskSpace},
+	}
+
+	// run all checks concurrently, checks which do not finish by the timeout fail
+	results := make([]chan HealthCheckResult, len(checks))
+	for i, check := range checks {
+		results[i] = make(chan HealthCheckResult, 1)
+		go func(check healthCheck, ch chan<- HealthCheckResult) {
+			ch <- runHealthCheck(check)
+		}(check, results[i])
+	}
+
+	report := &ReadinessReport{
+		Ready: true,
+		Checks: make([]HealthCheckResult, len(checks)),
+	}
+	deadline := time.After(healthCheckTimeout)		// shared, so that the report takes the timeout at most
+	timedOut := false
+	for i, check := range checks {
+		ok := false
+		if timedOut {
+			// take results which have been made in time
+			select {
+			case report.Checks[i] = <-results[i]:
+				ok = true
+			default:
+			}
+		} else {
+			select {
+			case report.Checks[i] = <-results[i]:
+				ok = true
+			case <-deadline:
+				timedOut = true
+			}
+		}
+
+		if !ok {
+			report.Checks[i] = HealthCheckResult{
+				Name: check.name,
+				OK: false,
+				Message: "timeout",
+				ElapsedMs: int64(healthCheckTimeout / time.Millisecond),
+			}
+		}
+
+		if !report.Checks[i].OK {
+			report.Ready = false
+		}
+	}
+
+	return report
+}
+
+func runHealthCheck(check healthCheck) HealthCheckResult {
+	startT := time.Now()
+	err := check.f()
+
+	r := HealthCheckResult{
+		Name: check.name,
+		OK: err == nil,
+		ElapsedMs: int64(time.Since(startT) / time.Millisecond),
+	}
+	if err != nil {
+		r.Message = err.Error()
+	}
+
+	return r
+}
+
+func (ctx *SubakoContext) checkDatabase() error {
+	probe := &healthProbe{
+		ID: 1,
+		CheckedAt: time.Now(),
+	}
+
+	return ctx.db.Save(probe).Error
+}
+
+func (ctx *SubakoContext) checkDiskSpace() error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(ctx.StorageDir, &st); err != nil {
+		return err
+	}
+
+	free := st.Bavail * uint64(st.Bsize)
+	if free < ctx.MinFreeDiskBytes {
+		return fmt.Errorf("only %d MiB is free in %s (required: %d MiB)", free / 1024 / 1024, ctx.StorageDir, ctx.MinFreeDiskBytes / 1024 / 1024)
+	}
+
+	return nil
+}
+
+
+func (ctx *AptRepositoryContext) CheckReprepro() error {
+	args := ctx.reprepro.MakeVersionCommand()
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+
+	return nil
+}
+
+
+func (ctx *BuilderContext) Ping() error {
+	return ctx.client.Ping()
+}
+
+func (ctx *BuilderContext) CheckImage() error {
+	if _, err := ctx.client.InspectImage(builderImageName); err != nil {
+		return fmt.Errorf("image %s: %v", builderImageName, err)
+	}
+
+	return nil
+}
@@ -20,8 +20,6 @@ type LanguageVersion	string
 
 
 // Unit
-// TODO:
-// if version contains charactors sush as '/', make them error
 type LangConfig struct {
 	name				LanguageName
 	version				LanguageVersion
@@ -30,44 +28,71 @@ type LangConfig struct {
 
 // Set
 type LangConfigSet struct {
-	Name				LanguageName			`json:"name"`
-	Versions			[]LanguageVersion		`json:"versions"`
+	Name				LanguageName			`json:"name" schema:"required"`
+	Versions			[]LanguageVersion		`json:"versions" schema:"required"`
 	Type				string					`json:"type"`
+	Aliases				VersionAliases			`json:"aliases"`	// override aliases of the package
 
 	Configs				map[LanguageVersion]*LangConfig
 	ProfileTemplate		*ProfileTemplate
 	ProfilePatches		[]*ProfilePatch
+
+	basePath			string
 }
 
 
-func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
+// makeLangConfigSet reads the language config. Problems are appended to errs, and nil is returned if the config cannot be read.
+func makeLangConfigSet(baseDir targetPath, errs *ConfigErrors) *LangConfigSet {
 	// load language config
 	configPath := path.Join(string(baseDir), "config.json")
 	log.Println("lang config path", configPath);
 
 	file, err := ioutil.ReadFile(configPath)
     if err != nil {
-        return nil, err
+		errs.add(configPath, "", "%v", err)
+		return nil
     }
 
+	var doc interface{}
+	if err := json.Unmarshal(file, &doc); err != nil {
+		errs.add(configPath, "", "invalid JSON: %v", err)
+		return nil
+	}
+	numErrs := len(*errs)
+	validateConfigDocument("lang_config", doc, configPath, errs)
+	if len(*errs) > numErrs {
+		return nil		// the content cannot be trusted
+	}
+
 	configSet := &LangConfigSet{
 		Configs: make(map[LanguageVersion]*LangConfig),
+		basePath: string(baseDir),
 	}
 	if err := json.Unmarshal(file, configSet); err != nil {
-		return nil, err
+		errs.add(configPath, "", "invalid JSON: %v", err)
+		return nil
 	}
 
-	if len(configSet.Name) == 0 {
-		panic("name")	// TODO: fix
+	if reason := checkConfigName(string(configSet.Name)); reason != "" {
+		errs.add(configPath, "name", "%s", reason)
 	}
 
-	if configSet.Versions == nil || len(configSet.Versions) == 0 {
-		panic("versions")	// TODO: fix
+	if len(configSet.Versions) == 0 {
+		errs.add(configPath, "versions", "must have at least one version")
 	}
 
-
 	// read config
-	for _, version := range configSet.Versions {
+	for i, version := range configSet.Versions {
+		field := fmt.Sprintf("versions[%d]", i)
+		if reason := checkConfigVersion(string(version)); reason != "" {
+			errs.add(configPath, field, "%s (%q)", reason, version)
+			continue
+		}
+		if _, ok := configSet.Configs[version]; ok {
+			errs.add(configPath, field, "duplicated version %q", version)
+			continue
+		}
+
 		config := &LangConfig{
 			name: configSet.Name,
 			version: version,
@@ -76,6 +101,12 @@ func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
 		configSet.Configs[version] = config
 	}
 
+	versions := make([]string, len(configSet.Versions))
+	for i, v := range configSet.Versions {
+		versions[i] = string(v)
+	}
+	checkAliases(configSet.Aliases, versions, configPath, errs)
+
 
 	// templates
 	ptBasePath := filepath.Join(string(baseDir), "profile_templates")
@@ -86,7 +117,7 @@ func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
 	if Exists(ptPath) {
 		pt, err := readProfileTemplate(ptPath)
 		if err != nil {
-			return nil, fmt.Errorf("%v at %s", err, ptPath)
+			errs.addError(ptPath, err)
 		}
 		profileTemplate = pt
 	}
@@ -94,6 +125,10 @@ func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
 	// read profile patch
 	patches := make([]*ProfilePatch, 0)
 	if err := filepath.Walk(ptBasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == ptBasePath { return nil }
+			return err
+		}
 		if path == ptBasePath { return nil }
 		if info.IsDir() { return nil }
 		// do not collect files that name is started by _ or .
@@ -108,7 +143,8 @@ func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
 		if strings.HasPrefix(filepath.Base(path), "patch_") {
 			pt, err := readProfilePatch(path)
 			if err != nil {
-				return fmt.Errorf("%v at %s", err, path)
+				errs.addError(path, err)
+				return nil
 			}
 			patches = append(patches, pt)
 			return nil
@@ -117,7 +153,7 @@ func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
 		return nil
 
 	}); err != nil {
-		return nil, err
+		errs.add(ptBasePath, "", "%v", err)
 	}
 
 	log.Printf("Results: %v\n", *configSet)
@@ -126,5 +162,5 @@ func makeLangConfigSet(baseDir targetPath) (*LangConfigSet, error) {
 	configSet.ProfileTemplate = profileTemplate
 	configSet.ProfilePatches = patches
 
-	return configSet, nil
+	return configSet
 }
@@ -0,0 +1,202 @@
+package subako
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+
+var rePlaceholder = regexp.MustCompile("%{([^}]*)}")
+
+// LintConfigSets checks config sets in the dir without Subako.
+// In addition to problems which are found by loading, references between configs and placeholders are checked.
+func LintConfigSets(baseDir string) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	paths, err := globConfigPaths(baseDir)
+	if err != nil {
+		errs.add(baseDir, "", "%v", err)
+		return errs
+	}
+
+	sets := make(map[PackageName]*PackageBuildConfigSet)
+	setPaths := make(map[PackageName]string)
+	for _, p := range paths {
+		tc := makeProcConfigSet(p, &errs)
+		if tc == nil {
+			continue
+		}
+
+		configPath := path.Join(string(p), "package_config.json")
+		if _, ok := sets[tc.Name]; ok {
+			errs.add(configPath, "name", "duplicated package %q", tc.Name)
+			continue
+		}
+		sets[tc.Name] = tc
+		setPaths[tc.Name] = configPath
+	}
+
+	// all languages in config sets
+	langs := make(map[LanguageName]*LangConfigSet)
+	for _, tc := range sets {
+		for name, lc := range tc.LangConfigs {
+			langs[name] = lc
+		}
+	}
+
+	for _, name := range sortedPackageNames(sets) {
+		tc := sets[name]
+		configPath := setPaths[name]
+
+		lintReferences(tc, configPath, sets, &errs)
+
+		for _, lc := range tc.SortedLangConfigs() {
+			lintLangConfig(lc, langs, &errs)
+		}
+	}
+	collectLangAliases(sets, &errs)		// only to check conflicts
+
+	return errs
+}
+
+func lintReferences(
+	tc			*PackageBuildConfigSet,
+	configPath	string,
+	sets		map[PackageName]*PackageBuildConfigSet,
+	errs		*ConfigErrors,
+) {
+	for i, ref := range tc.QueueWith {
+		if _, ok := sets[ref]; !ok {
+			errs.add(configPath, "queue_with", "[%d] unknown package %q", i, ref)
+		}
+	}
+
+	for depName, depVersions := range tc.DepPkgs {
+		dep, ok := sets[depName]
+		if !ok {
+			errs.add(configPath, "dep_pkgs." + string(depName), "unknown package %q", depName)
+			continue
+		}
+
+		for i, version := range depVersions {
+			if _, ok := dep.Configs[version]; !ok {
+				errs.add(configPath, "dep_pkgs." + string(depName), "[%d] %s has no version %q", i, depName, version)
+			}
+		}
+	}
+
+	for i, req := range tc.Deps {
+		field := fmt.Sprintf("deps[%d]", i)
+		dep, ok := sets[req.Name]
+		if !ok {
+			errs.add(configPath, field, "unknown package %q", req.Name)
+			continue
+		}
+
+		for j, version := range req.Versions {
+			if _, ok := dep.Configs[version]; !ok {
+				errs.add(configPath, field, "[%d] %s has no version %q", j, req.Name, version)
+			}
+		}
+	}
+}
+
+func lintLangConfig(
+	lc			*LangConfigSet,
+	langs		map[LanguageName]*LangConfigSet,
+	errs		*ConfigErrors,
+) {
+	if lc.ProfileTemplate != nil {
+		ptPath := filepath.Join(lc.basePath, "profile_templates", "template.yml")
+		t := lc.ProfileTemplate
+
+		lintPlaceholders(ptPath, "display_version", []string{t.DisplayVersion}, errs)
+		lintPlaceholders(ptPath, "compile", execTemplateStrings(t.Compile), errs)
+		lintPlaceholders(ptPath, "link", execTemplateStrings(t.Link), errs)
+		lintPlaceholders(ptPath, "exec", execTemplateStrings(t.Exec), errs)
+	}
+
+	for _, patch := range lc.ProfilePatches {
+		patchPath := patch.filePath
+		for _, version := range patch.From.Versions {
+			if _, ok := lc.Configs[version]; !ok {
+				errs.add(patchPath, "from.versions", "%s has no version %q", lc.Name, version)
+			}
+		}
+
+		to, ok := langs[patch.To.Name]
+		if !ok {
+			errs.add(patchPath, "to.name", "unknown language %q", patch.To.Name)
+		} else {
+			for _, version := range patch.To.Versions {
+				if _, ok := to.Configs[version]; !ok {
+					errs.add(patchPath, "to.versions", "%s has no version %q", to.Name, version)
+				}
+			}
+		}
+
+		lintPlaceholders(patchPath, "append.compile", execTemplateStrings(patch.Append.Compile), errs)
+		lintPlaceholders(patchPath, "append.link", execTemplateStrings(patch.Append.Link), errs)
+		lintPlaceholders(patchPath, "append.exec", execTemplateStrings(patch.Append.Exec), errs)
+	}
+}
+
+func lintPlaceholders(filePath, field string, values []string, errs *ConfigErrors) {
+	for _, v := range values {
+		for _, m := range rePlaceholder.FindAllStringSubmatch(v, -1) {
+			if !isKnownPlaceholder(m[1]) {
+				errs.add(filePath, field, "undefined placeholder %s", m[0])
+			}
+		}
+	}
+}
+
+func isKnownPlaceholder(name string) bool {
+	for _, known := range knownPlaceholders {
+		if name == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// execTemplateStrings returns all strings which are replaced by the generation
+func execTemplateStrings(t *ExecProfileTemplate) []string {
+	if t == nil {
+		return nil
+	}
+
+	values := []string{t.Extension}
+	values = append(values, t.Commands...)
+	for k, v := range t.Envs {
+		values = append(values, k, v)
+	}
+	for _, commands := range t.FixedCommands {
+		values = append(values, commands...)
+	}
+	for k, options := range t.SelectableOptions {
+		values = append(values, k)
+		values = append(values, options...)
+	}
+
+	return values
+}
+
+func sortedPackageNames(sets map[PackageName]*PackageBuildConfigSet) []PackageName {
+	var keys []string
+	for k := range sets {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+
+	names := make([]PackageName, len(keys))
+	for i, k := range keys {
+		names[i] = PackageName(k)
+	}
+
+	return names
+}
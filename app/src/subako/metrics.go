@@ -0,0 +1,134 @@
+package subako
+
+import (
+	"os"
+	"math"
+	"time"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+
+const metricsNamespace = "subako"
+
+type Metrics struct {
+	Registry				*prometheus.Registry
+
+	BuildDuration			*prometheus.HistogramVec
+	BuildResults			*prometheus.CounterVec
+	NotificationFailures	prometheus.Counter
+	WebhookDeliveries		*prometheus.CounterVec
+}
+
+func MakeMetrics(ctx *SubakoContext) (*Metrics, error) {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		BuildDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name: "build_duration_seconds",
+			Help: "Duration of builds in containers.",
+			Buckets: prometheus.ExponentialBuckets(30, 2, 10),	// 30sec ~ 4hours
+		}, []string{"package"}),
+
+		BuildResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name: "build_results_total",
+			Help: "Number of finished builds by result.",
+		}, []string{"package", "result"}),
+
+		NotificationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name: "notification_failures_total",
+			Help: "Number of notifications which could not be delivered.",
+		}),
+
+		WebhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name: "webhook_deliveries_total",
+			Help: "Number of received webhooks by outcome.",
+		}, []string{"outcome"}),
+	}
+
+	m.Registry.MustRegister(
+		m.BuildDuration,
+		m.BuildResults,
+		m.NotificationFailures,
+		m.WebhookDeliveries,
+		prometheus.NewGoCollector(),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name: "queued_tasks",
+			Help: "Number of tasks waiting in the queue.",
+		}, func() float64 {
+			return float64(ctx.QueueLength())
+		}),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name: "running_builds",
+			Help: "Number of running builds.",
+		}, func() float64 {
+			return float64(ctx.RunningTasks.CountActive())
+		}),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name: "apt_repository_size_bytes",
+			Help: "Total size of files in the APT repository.",
+		}, func() float64 {
+			return float64(ctx.AptRepoCtx.Size())
+		}),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name: "profiles_age_seconds",
+			Help: "Seconds since the profile set was generated.",
+		}, func() float64 {
+			generatedAt := ctx.Profiles.GeneratedAt
+			if generatedAt == 0 {
+				return math.NaN()
+			}
+			return time.Since(time.Unix(generatedAt, 0)).Seconds()
+		}),
+	)
+
+	return m, nil
+}
+
+func (m *Metrics) observeBuild(name PackageName, task *RunningTask, duration time.Duration) {
+	if duration > 0 {
+		m.BuildDuration.WithLabelValues(string(name)).Observe(duration.Seconds())
+	}
+
+	result := ""
+	switch task.Status {
+	case TaskSucceeded:
+		result = "succeeded"
+	case TaskWarning:
+		result = "warning"
+	case TaskFailed:
+		result = "failed"
+	case TaskAborted:
+		result = "aborted"
+	default:
+		return
+	}
+	m.BuildResults.WithLabelValues(string(name), result).Inc()
+}
+
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil { return nil }	// ignore
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
@@ -2,8 +2,9 @@ package subako
 
 import (
 	"log"
-	"sort"
 	"fmt"
+	"sort"
+	"strings"
 	"encoding/json"
 	"path"
 	"io/ioutil"
@@ -25,17 +26,33 @@ type IPackageBuildConfig interface {
 	makeWorkDirName() string
 	makePackagePathName() string
 
-	GetDepName() PackageName
+	GetDepName() PackageName		// the first dependency
 	GetDepVersion() PackageVersion
+	GetDeps() DepTuple
 	GetGenPkgName() string
-	GetDepPackage() *AvailablePackage
+	GetDepPackages() []*AvailablePackage
 
 	GetRepDeps() []PackageName
+	GetFingerprint() string
+	GetSnapshot() *ProcConfigSnapshot
+	GetSource() *PackageSource
 }
 
+// PackageTargetID returns an identifier of the build target for the audit log
+func PackageTargetID(name, version, depKey string) string {
+	if depKey == "" {
+		return name + "/" + version
+	}
+
+	return name + "/" + version + " with " + depKey
+}
+
+func BuildConfigTargetID(c IPackageBuildConfig) string {
+	return PackageTargetID(string(c.GetName()), string(c.GetVersion()), c.GetDeps().Key())
+}
+
+
 // Unit
-// TODO:
-// if version contains charactors sush as '/', make them error
 type PackageBuildConfig struct {
 	name				string
 	version				string
@@ -44,6 +61,10 @@ type PackageBuildConfig struct {
 	basePath			string
 
 	refDeps				[]PackageName
+	fingerprint			string		// hash of inputs of the build (see fingerprintConfigDir)
+
+	snapshot			*ProcConfigSnapshot		// config sets which contain this config
+	source				*PackageSource			// nil if the version is not built from the source
 }
 
 func (tc *PackageBuildConfig) makeWorkDirName() string {
@@ -61,57 +82,90 @@ func (tc *PackageBuildConfig) GetTargetArch() string { return tc.targetArch }
 func (tc *PackageBuildConfig) GetBasePath() string { return tc.basePath }
 func (tc *PackageBuildConfig) GetDepName() PackageName { return PackageName("") }
 func (tc *PackageBuildConfig) GetDepVersion() PackageVersion { return PackageVersion("") }
+func (tc *PackageBuildConfig) GetDeps() DepTuple { return nil }
 func (tc *PackageBuildConfig) GetGenPkgName() string { return tc.name }
-func (tc *PackageBuildConfig) GetDepPackage() *AvailablePackage { return nil }
+func (tc *PackageBuildConfig) GetDepPackages() []*AvailablePackage { return nil }
 
 func (tc *PackageBuildConfig) GetRepDeps() []PackageName { return tc.refDeps }
+func (tc *PackageBuildConfig) GetFingerprint() string { return tc.fingerprint }
+func (tc *PackageBuildConfig) GetSnapshot() *ProcConfigSnapshot { return tc.snapshot }
+func (tc *PackageBuildConfig) GetSource() *PackageSource { return tc.source }
 
 
-//
+// Names have a part for each dependency, so names of builds with one dependency are not changed
 type PackageBuildConfigWithDep struct {
 	*PackageBuildConfig
-	DepAP		*AvailablePackage
+	DepAPs		[]*AvailablePackage		// at least one
 }
 
 func (tc *PackageBuildConfigWithDep) makeWorkDirName() string {
-	return fmt.Sprintf("%s-%s-%s-with-%s-%s", tc.name, tc.targetSystem, tc.version, tc.DepAP.Name, tc.DepAP.Version)
+	name := fmt.Sprintf("%s-%s-%s", tc.name, tc.targetSystem, tc.version)
+	for _, ap := range tc.DepAPs {
+		name += fmt.Sprintf("-with-%s-%s", ap.Name, ap.Version)
+	}
+	return name
 }
 
 func (tc *PackageBuildConfigWithDep) makePackagePathName() string {
-	return fmt.Sprintf("%s.%s.with.%s.%s", tc.name, tc.version, tc.DepAP.Name, tc.DepAP.Version)
+	name := fmt.Sprintf("%s.%s", tc.name, tc.version)
+	for _, ap := range tc.DepAPs {
+		name += fmt.Sprintf(".with.%s.%s", ap.Name, ap.Version)
+	}
+	return name
 }
 
 func (tc *PackageBuildConfigWithDep) GetDepName() PackageName {
-	return tc.DepAP.Name
+	return tc.DepAPs[0].Name
 }
 func (tc *PackageBuildConfigWithDep) GetDepVersion() PackageVersion {
-	return tc.DepAP.Version
+	return tc.DepAPs[0].Version
+}
+func (tc *PackageBuildConfigWithDep) GetDeps() DepTuple {
+	deps := make(DepTuple, len(tc.DepAPs))
+	for i, ap := range tc.DepAPs {
+		deps[i] = DepPackage{Name: ap.Name, Version: ap.Version}
+	}
+	return deps
 }
 func (tc *PackageBuildConfigWithDep) GetGenPkgName() string {
-	return fmt.Sprintf("%s--with-%s.%s-", tc.name, tc.DepAP.Name, tc.DepAP.Version)
+	name := tc.name
+	for _, ap := range tc.DepAPs {
+		name += fmt.Sprintf("--with-%s.%s", ap.Name, ap.Version)
+	}
+	return name + "-"
 }
-func (tc *PackageBuildConfigWithDep) GetDepPackage() *AvailablePackage { return tc.DepAP }
+func (tc *PackageBuildConfigWithDep) GetDepPackages() []*AvailablePackage { return tc.DepAPs }
 
 
 // Set
 type PackageBuildConfigSet struct {
-	Name				PackageName			`json:"name"`
-	Versions			[]PackageVersion	`json:"versions"`
+	Name				PackageName			`json:"name" schema:"required"`
+	Versions			[]PackageVersion	`json:"versions" schema:"required"`
 	QueueWith			[]PackageName		`json:"queue_with"`
 
-	DepPkgs				map[PackageName][]PackageVersion	`json:"dep_pkgs"`
+	DepPkgs				map[PackageName][]PackageVersion	`json:"dep_pkgs"`	// built with one of them
+	Deps				[]DepRequirement	`json:"deps"`		// built with all of them
+	AutoRebuild			*bool				`json:"auto_rebuild"`	// default: true
+	Aliases				VersionAliases		`json:"aliases"`		// for all languages in the package
+	Source				*PackageSource		`json:"source"`
 
 	Configs				map[PackageVersion]*PackageBuildConfig
 
 	LangConfigs			map[LanguageName]*LangConfigSet
 }
 
+// IsAutoRebuildEnabled returns true if built packages are queued automatically when the config is changed
+func (pc *PackageBuildConfigSet) IsAutoRebuildEnabled() bool {
+	return pc.AutoRebuild == nil || *pc.AutoRebuild
+}
+
+// SortedConfigs returns configs from the newest version
 func (pc *PackageBuildConfigSet) SortedConfigs() []*PackageBuildConfig {
 	var keys []string
     for k := range pc.Configs {
         keys = append(keys, string(k))
     }
-    sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+    SortVersions(keys)
 
 	var confs []*PackageBuildConfig
 	for _, version := range keys {
@@ -127,7 +181,7 @@ func (pc *PackageBuildConfigSet) SortedLangConfigs() []*LangConfigSet {
     for k := range pc.LangConfigs {
         keys = append(keys, string(k))
     }
-    sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+    sort.Strings(keys)
 
 	var confs []*LangConfigSet
 	for _, name := range keys {
@@ -147,15 +201,20 @@ func (pc *PackageBuildConfigSet) SortedDepPkgs() []SDepPkg {
     for k := range pc.DepPkgs {
         keys = append(keys, string(k))
     }
-    sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+    sort.Strings(keys)
 
 	var confs []SDepPkg
 	for _, name := range keys {
-		vers := pc.DepPkgs[PackageName(name)]
+		var vers []string
+		for _, ver := range pc.DepPkgs[PackageName(name)] {
+			vers = append(vers, string(ver))
+		}
+		SortVersions(vers)
+
 		for _, ver := range vers {
 			confs = append(confs, SDepPkg{
 				Name: PackageName(name),
-				Version: ver,
+				Version: PackageVersion(ver),
 			})
 		}
 	}
@@ -164,38 +223,56 @@ func (pc *PackageBuildConfigSet) SortedDepPkgs() []SDepPkg {
 }
 
 
-func makeProcConfigSet(baseDir targetPath) (*PackageBuildConfigSet, error) {
+// makeProcConfigSet reads the package config. Problems are appended to errs, and nil is returned if the config cannot be read.
+func makeProcConfigSet(baseDir targetPath, errs *ConfigErrors) *PackageBuildConfigSet {
 	configPath := path.Join(string(baseDir), "package_config.json")
 	log.Println("package config path", configPath);
 
 	file, err := ioutil.ReadFile(configPath)
     if err != nil {
-        return nil, err
+		errs.add(configPath, "", "%v", err)
+		return nil
     }
 
+	var doc interface{}
+	if err := json.Unmarshal(file, &doc); err != nil {
+		errs.add(configPath, "", "invalid JSON: %v", err)
+		return nil
+	}
+	numErrs := len(*errs)
+	validateConfigDocument("package_config", doc, configPath, errs)
+	if len(*errs) > numErrs {
+		return nil		// the content cannot be trusted
+	}
+
 	configSet := &PackageBuildConfigSet{
 		Configs: make(map[PackageVersion]*PackageBuildConfig),
 		LangConfigs: make(map[LanguageName]*LangConfigSet),
 	}
 	if err := json.Unmarshal(file, configSet); err != nil {
-		return nil, err
+		errs.add(configPath, "", "invalid JSON: %v", err)
+		return nil
 	}
 
-	if len(configSet.Name) == 0 {
-		panic("name")	// TODO: fix
+	if reason := checkConfigName(string(configSet.Name)); reason != "" {
+		errs.add(configPath, "name", "%s", reason)
 	}
 
-	if configSet.Versions == nil || len(configSet.Versions) == 0 {
-		panic("versions")	// TODO: fix
-	}
-
-	if !Exists(path.Join(string(baseDir), "install.sh")) {
-		// TODO: error check...?
+	if len(configSet.Versions) == 0 {
+		errs.add(configPath, "versions", "must have at least one version")
 	}
+	for i, version := range configSet.Versions {
+		field := fmt.Sprintf("versions[%d]", i)
+		if reason := checkConfigVersion(string(version)); reason != "" {
+			errs.add(configPath, field, "%s (%q)", reason, version)
+			continue
+		}
+		if _, ok := configSet.Configs[version]; ok {
+			errs.add(configPath, field, "duplicated version %q", version)
+			continue
+		}
 
-	// read config
-	for _, version := range configSet.Versions {
-		config := &PackageBuildConfig{
+		configSet.Configs[version] = &PackageBuildConfig{
 			name: string(configSet.Name),
 			version: string(version),
 			targetSystem: "x86_64-linux-gnu",	// tmp
@@ -204,24 +281,83 @@ func makeProcConfigSet(baseDir targetPath) (*PackageBuildConfigSet, error) {
 
 			refDeps: configSet.QueueWith,
 		}
+	}
+
+	versions := make([]string, len(configSet.Versions))
+	for i, v := range configSet.Versions {
+		versions[i] = string(v)
+	}
+	checkAliases(configSet.Aliases, versions, configPath, errs)
+
+	if configSet.Source != nil {
+		checkPackageSource(configSet.Source, configSet.Versions, configPath, errs)
+		for version, config := range configSet.Configs {
+			if configSet.Source.appliesTo(version) {
+				config.source = configSet.Source
+			}
+		}
+	}
 
-		configSet.Configs[version] = config
+	for i, name := range configSet.QueueWith {
+		if reason := checkConfigName(string(name)); reason != "" {
+			errs.add(configPath, fmt.Sprintf("queue_with[%d]", i), "%s", reason)
+		}
+	}
+
+	for depName, depVersions := range configSet.DepPkgs {
+		field := fmt.Sprintf("dep_pkgs.%s", depName)
+		if reason := checkConfigName(string(depName)); reason != "" {
+			errs.add(configPath, field, "%s", reason)
+		} else if strings.Contains(string(depName), ",") {
+			errs.add(configPath, field, "must not contain ','")		// separator of dep keys
+		}
+		if len(depVersions) == 0 {
+			errs.add(configPath, field, "must have at least one version")
+		}
+		for i, version := range depVersions {
+			if reason := checkConfigVersion(string(version)); reason != "" {
+				errs.add(configPath, fmt.Sprintf("%s[%d]", field, i), "%s (%q)", reason, version)
+			} else if strings.Contains(string(version), ",") {
+				errs.add(configPath, fmt.Sprintf("%s[%d]", field, i), "must not contain ','")
+			}
+		}
+	}
+
+	checkDepRequirements(configSet.Deps, configPath, errs)
+
+	if !Exists(path.Join(string(baseDir), "install.sh")) {
+		errs.add(path.Join(string(baseDir), "install.sh"), "", "install.sh is not found")
 	}
 
 	//
 	langConfigPaths, err := globConfigPaths(string(baseDir))
 	if err != nil {
-		return nil, err
+		errs.add(string(baseDir), "", "%v", err)
+		return nil
 	}
 	log.Printf("lang configs glob : %v", langConfigPaths)
+
+	fingerprint, err := fingerprintConfigDir(string(baseDir), langConfigPaths)
+	if err != nil {
+		errs.add(string(baseDir), "", "failed to fingerprint: %v", err)
+		return nil
+	}
+	for _, config := range configSet.Configs {
+		config.fingerprint = fingerprintVersion(fingerprint, config.source)
+	}
+
 	for _, p := range langConfigPaths {
-		config, err := makeLangConfigSet(p)
-		if err != nil {
-			return nil, err
+		config := makeLangConfigSet(p, errs)
+		if config == nil {
+			continue
+		}
+
+		if _, ok := configSet.LangConfigs[config.Name]; ok {
+			errs.add(path.Join(string(p), "config.json"), "name", "duplicated language %q in %s", config.Name, configSet.Name)
+			continue
 		}
 		configSet.LangConfigs[config.Name] = config;
 	}
 
-
-	return configSet, nil
+	return configSet
 }
@@ -0,0 +1,309 @@
+package subako
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+
+// RemovalMode decides what happens to packages which were built with the removed package
+type RemovalMode string
+
+const (
+	RemovalRefuse = RemovalMode("refuse")		// nothing is removed if there are dependents
+	RemovalCascade = RemovalMode("cascade")		// dependents are also removed
+	RemovalOrphan = RemovalMode("orphan")		// dependents are left and marked as orphaned
+)
+
+func ParseRemovalMode(s string) (RemovalMode, error) {
+	switch RemovalMode(s) {
+	case "", RemovalRefuse:
+		return RemovalRefuse, nil
+	case RemovalCascade, RemovalOrphan:
+		return RemovalMode(s), nil
+	}
+
+	return "", fmt.Errorf("unknown removal mode %q (refuse, cascade or orphan)", s)
+}
+
+// RemovalReport is the result of the removal. Values are target IDs of packages.
+type RemovalReport struct {
+	Target			string
+	Dependents		[]string
+	Removed			[]string
+	Orphaned		[]string
+}
+
+// DependentsError is returned when the removal is refused
+type DependentsError struct {
+	Target			string
+	Dependents		[]string
+}
+
+func (e *DependentsError) Error() string {
+	return fmt.Sprintf("%s is a dependency of %d packages", e.Target, len(e.Dependents))
+}
+
+func availablePackageTargetID(a *AvailablePackage) string {
+	return PackageTargetID(string(a.Name), string(a.Version), a.DepKey)
+}
+
+
+// FindDependents returns packages which were built with the package
+func (ap *AvailablePackages) FindDependents(name PackageName, version PackageVersion) []AvailablePackage {
+	ap.m.Lock()
+	defer ap.m.Unlock()
+
+	dependents := make([]AvailablePackage, 0)
+	for _, packages := range ap.Packages {
+		for _, depPkgMap := range packages {
+			for _, pkg := range depPkgMap {
+				if pkg.GetDeps().Contains(name, version) {
+					dependents = append(dependents, pkg)
+				}
+			}
+		}
+	}
+	sort.Stable(availablePackagesOrder(dependents))
+
+	return dependents
+}
+
+// SetOrphaned updates the mark of the package
+func (ap *AvailablePackages) SetOrphaned(name PackageName, version PackageVersion, depKey string, orphaned bool) error {
+	a, err := ap.FindDep(name, version, depKey)
+	if err != nil {
+		return err
+	}
+	if a.Orphaned == orphaned {
+		return nil
+	}
+	a.Orphaned = orphaned
+
+	return ap.Update(a, nil)
+}
+
+
+// Dependents returns packages which are affected by the removal of the slot.
+// Dependencies are always resolved to the slot without deps, so other slots have no dependents.
+func (ctx *SubakoContext) Dependents(name, version, depKey string) []AvailablePackage {
+	if depKey != "" {
+		return make([]AvailablePackage, 0)
+	}
+
+	return ctx.AvailablePackages.FindDependents(PackageName(name), PackageVersion(version))
+}
+
+// PreviewRemoval returns packages which are affected by the removal without removing anything
+func (ctx *SubakoContext) PreviewRemoval(name, version, depKey string) (*RemovalReport, error) {
+	pkg, err := ctx.AvailablePackages.FindDep(PackageName(name), PackageVersion(version), depKey)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RemovalReport{
+		Target: availablePackageTargetID(pkg),
+		Dependents: make([]string, 0),
+		Removed: make([]string, 0),
+		Orphaned: make([]string, 0),
+	}
+	for _, d := range ctx.Dependents(name, version, depKey) {
+		report.Dependents = append(report.Dependents, availablePackageTargetID(&d))
+	}
+
+	return report, nil
+}
+
+func (ctx *SubakoContext) RemovePackage(name, version string, mode RemovalMode) (*RemovalReport, error) {
+	return ctx.RemovePackageDep(name, version, "", mode)
+}
+
+// RemovePackageDep removes the package which was built with the tuple of depKey.
+// Packages which were built with it are handled by the mode. The report is returned even if it fails on the way.
+func (ctx *SubakoContext) RemovePackageDep(name, version, depKey string, mode RemovalMode) (*RemovalReport, error) {
+	report, err := ctx.PreviewRemoval(name, version, depKey)
+	if err != nil {
+		ctx.Logger.Failed("RemovePackage", err.Error())
+		return nil, err
+	}
+	dependents := ctx.Dependents(name, version, depKey)
+
+	if len(dependents) > 0 && mode == RemovalRefuse {
+		err := &DependentsError{
+			Target: report.Target,
+			Dependents: report.Dependents,
+		}
+		ctx.Logger.Failed("RemovePackage", err.Error())
+		return report, err
+	}
+
+	// dependents first, so that nothing refers the removed package if it fails on the way
+	for _, d := range dependents {
+		switch mode {
+		case RemovalCascade:
+			if err := ctx.removePackageSlot(string(d.Name), string(d.Version), d.DepKey); err != nil {
+				return report, err
+			}
+			report.Removed = append(report.Removed, availablePackageTargetID(&d))
+
+		case RemovalOrphan:
+			if err := ctx.AvailablePackages.SetOrphaned(d.Name, d.Version, d.DepKey, true); err != nil {
+				ctx.Logger.Failed("RemovePackage", err.Error())
+				return report, err
+			}
+			report.Orphaned = append(report.Orphaned, availablePackageTargetID(&d))
+		}
+	}
+
+	if err := ctx.removePackageSlot(name, version, depKey); err != nil {
+		return report, err
+	}
+	report.Removed = append(report.Removed, report.Target)
+
+	return report, ctx.UpdateProfilesWithNotification()
+}
+
+// removePackageSlot removes the package from the apt repository and available packages
+func (ctx *SubakoContext) removePackageSlot(name, version, depKey string) error {
+	pkg, err := ctx.AvailablePackages.FindDep(
+		PackageName(name),
+		PackageVersion(version),
+		depKey,
+	)
+	if err != nil {
+		ctx.Logger.Failed("RemovePackage", err.Error())
+		return err
+	}
+
+	// remove from apt repository
+	pkgName := pkg.GeneratedPackageName
+	if err := ctx.AptRepoCtx.RemovePackage(pkgName); err != nil {
+		ctx.Logger.Failed("RemovePackage", fmt.Sprintf("Failed to remove from repo: %s / %s", pkgName, err.Error()))
+		return err
+	}
+
+	//
+	if err := ctx.AvailablePackages.Remove(name, version, depKey); err != nil {
+		ctx.Logger.Failed("RemovePackage", err.Error())
+		return err
+	}
+
+	ctx.Logger.Succeeded(fmt.Sprintf("RemovePackage: %s", PackageTargetID(name, version, depKey)))
+
+	return nil
+}
+
+
+const defaultOrphanCheckInterval = 1 * time.Hour
+
+// OrphanReport is the result of the periodic check
+type OrphanReport struct {
+	CheckedAt			time.Time
+	Orphans				[]string	// packages whose dependencies have been removed
+	NewlyOrphaned		[]string	// marked by this check
+	Recovered			[]string	// unmarked by this check because their dependencies have been built again
+	Unreferenced		[]string	// packages in the apt repository which no available packages refer
+	RepoError			string		// the apt repository could not be listed
+}
+
+type orphanCheckState struct {
+	last		*OrphanReport
+	m			sync.Mutex
+}
+
+// CheckOrphans marks packages whose dependencies are missing, and lists packages in the apt repository
+// which are not available packages (Ex. left by failed removals).
+func (ctx *SubakoContext) CheckOrphans() *OrphanReport {
+	report := &OrphanReport{
+		CheckedAt: time.Now(),
+		Orphans: make([]string, 0),
+		NewlyOrphaned: make([]string, 0),
+		Recovered: make([]string, 0),
+		Unreferenced: make([]string, 0),
+	}
+
+	referenced := make(map[string]bool)
+	for _, a := range ctx.AvailablePackages.SortedList() {
+		referenced[a.GeneratedPackageName] = true
+
+		missing := false
+		for _, d := range a.GetDeps() {
+			if _, err := ctx.AvailablePackages.Find(d.Name, d.Version); err != nil {
+				missing = true
+			}
+		}
+		id := availablePackageTargetID(&a)
+		if !missing {
+			if a.Orphaned {
+				if err := ctx.AvailablePackages.SetOrphaned(a.Name, a.Version, a.DepKey, false); err != nil {
+					log.Printf("OrphanCheck: failed to unmark %s / %v", id, err)
+					report.Orphans = append(report.Orphans, id)
+					continue
+				}
+				report.Recovered = append(report.Recovered, id)
+			}
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, id)
+		if !a.Orphaned {
+			if err := ctx.AvailablePackages.SetOrphaned(a.Name, a.Version, a.DepKey, true); err != nil {
+				log.Printf("OrphanCheck: failed to mark %s / %v", id, err)
+				continue
+			}
+			report.NewlyOrphaned = append(report.NewlyOrphaned, id)
+		}
+	}
+
+	entries, err := ctx.AptRepoCtx.ListPackages()
+	if err != nil {
+		report.RepoError = err.Error()
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if referenced[e.Name] || seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+		report.Unreferenced = append(report.Unreferenced, e.Name)
+	}
+	sort.Strings(report.Unreferenced)
+
+	ctx.orphanCheck.m.Lock()
+	ctx.orphanCheck.last = report
+	ctx.orphanCheck.m.Unlock()
+
+	if len(report.NewlyOrphaned) > 0 {
+		ctx.Audit.Record(SystemActor("orphan_check"), AuditOrphanPackages, "package", "", nil, report.NewlyOrphaned)
+	}
+	if len(report.Recovered) > 0 {
+		ctx.Audit.Record(SystemActor("orphan_check"), AuditOrphanPackages, "package", "", report.Recovered, nil)
+	}
+	if report.RepoError != "" {
+		ctx.Logger.Failed("OrphanCheck", report.RepoError)
+	} else {
+		ctx.Logger.Succeeded(fmt.Sprintf("OrphanCheck: %d orphans, %d recovered, %d unreferenced", len(report.Orphans), len(report.Recovered), len(report.Unreferenced)))
+	}
+
+	return report
+}
+
+// LastOrphanReport returns the result of the last check (nil if it has not been checked)
+func (ctx *SubakoContext) LastOrphanReport() *OrphanReport {
+	ctx.orphanCheck.m.Lock()
+	defer ctx.orphanCheck.m.Unlock()
+
+	return ctx.orphanCheck.last
+}
+
+func (ctx *SubakoContext) checkOrphansPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if ctx.isClosing() {
+			return
+		}
+		ctx.CheckOrphans()
+	}
+}
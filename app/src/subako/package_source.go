@@ -0,0 +1,88 @@
+package subako
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+
+const defaultPackageSourceRef = "HEAD"
+const packageSourceTimeout = 1 * time.Minute		// builds wait for it on the queue worker
+
+// PackageSource is the upstream repository of moving versions (Ex. HEAD).
+// Subako resolves the ref to a commit before building, so unchanged sources are not rebuilt.
+type PackageSource struct {
+	Git					string				`json:"git" schema:"required"`
+	Ref					string				`json:"ref"`		// default: HEAD
+	Versions			[]PackageVersion	`json:"versions"`	// default: moving versions such as HEAD
+}
+
+func (s *PackageSource) ref() string {
+	if s.Ref == "" {
+		return defaultPackageSourceRef
+	}
+	return s.Ref
+}
+
+// appliesTo returns true if the version is built from the source
+func (s *PackageSource) appliesTo(version PackageVersion) bool {
+	if len(s.Versions) == 0 {
+		_, ok := movingVersionRank(string(version))
+		return ok
+	}
+
+	for _, v := range s.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveCommit returns the commit which the ref points in the remote repository
+func (s *PackageSource) ResolveCommit() (string, error) {
+	out, err := runGitWithTimeout("", packageSourceTimeout, "ls-remote", "--", s.Git, s.ref())
+	if err != nil {
+		return "", err
+	}
+
+	// prefer the exact name, then branches, then tags (peeled tags point commits)
+	candidates := []string{s.ref(), "refs/heads/" + s.ref(), "refs/tags/" + s.ref() + "^{}", "refs/tags/" + s.ref()}
+	commits := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		commits[fields[1]] = fields[0]
+	}
+	for _, name := range candidates {
+		if commit, ok := commits[name]; ok {
+			return commit, nil
+		}
+	}
+
+	return "", fmt.Errorf("ref %q is not found in %s", s.ref(), s.Git)
+}
+
+func checkPackageSource(s *PackageSource, versions []PackageVersion, configPath string, errs *ConfigErrors) {
+	if s.Git == "" || strings.HasPrefix(s.Git, "-") {
+		errs.add(configPath, "source.git", "invalid repository %q", s.Git)
+	} else if strings.HasPrefix(s.Git, "ext::") {
+		errs.add(configPath, "source.git", "the ext transport is not allowed")
+	}
+	if err := checkGitRef(s.ref()); err != nil {
+		errs.add(configPath, "source.ref", "%v", err)
+	}
+
+	known := make(map[PackageVersion]bool)
+	for _, v := range versions {
+		known[v] = true
+	}
+	for i, v := range s.Versions {
+		if !known[v] {
+			errs.add(configPath, fmt.Sprintf("source.versions[%d]", i), "%q is not in versions", v)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package subako
+
+
+// QueueTaskKey identifies a queued build to persist the queue
+type QueueTaskKey struct {
+	Name		PackageName
+	Version		PackageVersion
+	DepName		PackageName		// only in queues which were saved before dep keys
+	DepVersion	PackageVersion
+	DepKey		string
+}
+
+func makeQueueTaskKey(c IPackageBuildConfig) QueueTaskKey {
+	return QueueTaskKey{
+		Name: c.GetName(),
+		Version: c.GetVersion(),
+		DepKey: c.GetDeps().Key(),
+	}
+}
+
+func (k QueueTaskKey) depKey() string {
+	if k.DepKey == "" {
+		return singleDepKey(k.DepName, k.DepVersion)
+	}
+	return k.DepKey
+}
+
+
+type PendingQueue struct {
+	Tasks		[]QueueTaskKey
+
+	HasFilePath
+}
+
+func LoadPendingQueue(path string) (*PendingQueue, error) {
+	var pq PendingQueue
+	if err := LoadStructure(path, &pq); err != nil {
+		return nil, err
+	}
+
+	return &pq, nil
+}
+
+func (pq *PendingQueue) Save() error {
+	return SaveStructure(pq)
+}
@@ -6,9 +6,11 @@ import (
 
 	"sync"
 	"errors"
+	"time"
 
 	"sort"
 
+	"path"
 	"path/filepath"
 	"fmt"
 	"strings"
@@ -22,6 +24,20 @@ type ProcConfigSetsConfig struct {
 	IsRemote		bool
 	BaseDir			string
 	Repository		string
+	Ref				string		// branch, tag or commit of the repository (default: master)
+	RefStatePath	string		// the ref which is pinned at runtime is saved here
+	SnapshotsDir	string		// copies of config sets for builds (builds read BaseDir if it is empty)
+}
+
+// PinnedConfigSetsRef overrides the ref in the config until it is reset
+type PinnedConfigSetsRef struct {
+	Ref			string
+
+	HasFilePath
+}
+
+func (p *PinnedConfigSetsRef) Save() error {
+	return SaveStructure(p)
 }
 
 
@@ -87,28 +103,153 @@ func globConfigPaths(genBaseDir string) ([]targetPath, error) {
 
 type ProcConfigMap map[PackageName]*PackageBuildConfigSet
 
+// ProcConfigSnapshot is config sets which were loaded at once. It is never modified after it is made,
+// so that builds can keep reading the snapshot which they started with while config sets are reloaded.
+type ProcConfigSnapshot struct {
+	Map				ProcConfigMap
+	Revision		string			// empty if config sets are not a git repository
+	HistoryID		uint			// 0 if the history is not recorded
+	LoadedAt		time.Time
+	Dir				string			// the tree which configs were read from. Builds mount it.
+}
+
+func (s *ProcConfigSnapshot) Find(
+	name, version		string,
+) (*PackageBuildConfig, error) {
+	if _, ok := s.Map[PackageName(name)]; !ok {
+		msg := fmt.Sprintf("There are no proc profiles for %s", name)
+		return nil, errors.New(msg)
+	}
+	configSet := s.Map[PackageName(name)]
+
+	if _, ok := configSet.Configs[PackageVersion(version)]; !ok {
+		msg := fmt.Sprintf("%s has no proc profile for version %s", name, version)
+		return nil, errors.New(msg)
+	}
+
+	return configSet.Configs[PackageVersion(version)], nil
+}
+
+// FindWithDeps returns the config which is built with the packages. All of them must have been built.
+func (s *ProcConfigSnapshot) FindWithDeps(
+	name, version			string,
+	deps					DepTuple,
+	aps						*AvailablePackages,
+) (*PackageBuildConfigWithDep, error) {
+	if len(deps) == 0 {
+		return nil, fmt.Errorf("(%s, %s) has no dependencies to be built with", name, version)
+	}
+
+	pkgBuildConf, err := s.Find(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	depAPs := make([]*AvailablePackage, len(deps))
+	for i, dep := range deps {
+		ap, err := aps.Find(dep.Name, dep.Version)
+		if err != nil {
+			return nil, err
+		}
+		depAPs[i] = ap
+	}
+
+	return &PackageBuildConfigWithDep{
+		PackageBuildConfig: pkgBuildConf,
+		DepAPs: depAPs,
+	}, nil
+}
+
+// FindBuildConfig returns the config which is built with the tuple of depKey (empty if there are no deps)
+func (s *ProcConfigSnapshot) FindBuildConfig(
+	name, version			string,
+	depKey					string,
+	aps						*AvailablePackages,
+) (IPackageBuildConfig, error) {
+	deps, err := ParseDepKey(depKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(deps) == 0 {
+		procConfig, err := s.Find(name, version)
+		if err != nil {
+			return nil, err
+		}
+		return procConfig, nil
+	}
+
+	procConfig, err := s.FindWithDeps(name, version, deps, aps)
+	if err != nil {
+		return nil, err
+	}
+	return procConfig, nil
+}
+
+func (s *ProcConfigSnapshot) SortedConfigSets() []*PackageBuildConfigSet {
+	var keys []string
+    for k := range s.Map {
+        keys = append(keys, string(k))
+    }
+    sort.Strings(keys)
+
+	var sets []*PackageBuildConfigSet
+	for _, name := range keys {
+		sets = append(sets, s.Map[PackageName(name)])
+	}
+
+	return sets
+}
+
+
 type ProcConfigSetsContext struct{
 	BaseDir			string
 	IsRemote		bool
 	Repo			*gitRepository
+	DefaultRef		string
+	PinnedRef		*PinnedConfigSetsRef
 
-	Map				ProcConfigMap
+	History			*ConfigHistoryContext
+	SnapshotsDir	string
 
-	m				sync.Mutex
+	dirRefs			map[string]int	// the current snapshot and tasks refer copies of config sets
+	dirsM			sync.Mutex
+
+	snapshot		*ProcConfigSnapshot
+	lastError		error			// error of the last update
+	rw				sync.RWMutex	// for snapshot and lastError
+
+	m				sync.Mutex		// reloads are serialized
 }
 
 func MakeProcConfigSetsContext(
 	config	*ProcConfigSetsConfig,
+	history	*ConfigHistoryContext,
 ) (*ProcConfigSetsContext, error) {
 	procConfigSetsCtx := &ProcConfigSetsContext{
 		BaseDir: config.BaseDir,
 		IsRemote: config.IsRemote,
+		DefaultRef: config.Ref,
+		PinnedRef: &PinnedConfigSetsRef{},
+		History: history,
+		SnapshotsDir: config.SnapshotsDir,
+		dirRefs: make(map[string]int),
+		snapshot: &ProcConfigSnapshot{
+			Map: make(ProcConfigMap),		// used if there are problems at the start
+		},
 	}
 
 	if config.IsRemote {
+		if config.RefStatePath != "" {
+			if err := LoadStructure(config.RefStatePath, procConfigSetsCtx.PinnedRef); err != nil {
+				return nil, err
+			}
+		}
+
 		procConfigSetsCtx.Repo = &gitRepository{
 			BaseDir: config.BaseDir,
 			Url: config.Repository,
+			Ref: procConfigSetsCtx.Ref(),
 		}
 	}
 
@@ -125,100 +266,267 @@ func MakeProcConfigSetsContext(
 	}
 
 	if err := procConfigSetsCtx.Update(); err != nil {
-		return nil, err
+		// start without config sets, problems are shown in the UI
+		if AsConfigErrors(err) == nil {
+			return nil, err
+		}
 	}
 
 	return procConfigSetsCtx, nil
 }
 
+// Snapshot returns the current config sets. The returned snapshot is not changed by reloads.
+func (ctx *ProcConfigSetsContext) Snapshot() *ProcConfigSnapshot {
+	ctx.rw.RLock()
+	defer ctx.rw.RUnlock()
+
+	return ctx.snapshot
+}
+
+// Glob reads all config sets. The current snapshot is replaced only when there are no problems,
+// otherwise ConfigErrors is returned and the previous config sets are kept.
 func (ctx *ProcConfigSetsContext) Glob() error {
 	newMap := make(ProcConfigMap)
+	errs := make(ConfigErrors, 0)
+
+	// read the copy, so that configs and files which builds use are the same
+	dir := ctx.BaseDir
+	if ctx.SnapshotsDir != "" {
+		exported, err := ctx.exportSnapshotDir()
+		if err != nil {
+			return err
+		}
+		dir = exported
+	}
+	discard := func() {
+		if dir != ctx.BaseDir {
+			os.RemoveAll(dir)
+		}
+	}
 
 	//
-	paths, err := globConfigPaths(ctx.BaseDir)
+	paths, err := globConfigPaths(dir)
 	if err != nil {
+		discard()
 		return err
 	}
 	log.Printf("package configs glob : %v", paths)
 
 	for _, v := range paths {
-		tc, err := makeProcConfigSet(v)
-		if err != nil {
-			return err
+		tc := makeProcConfigSet(v, &errs)
+		if tc == nil {
+			continue
+		}
+
+		if _, ok := newMap[tc.Name]; ok {
+			errs.add(path.Join(string(v), "package_config.json"), "name", "duplicated package %q", tc.Name)
+			continue
 		}
 		newMap[tc.Name] = tc
 	}
 
+	collectLangAliases(newMap, &errs)	// only to check conflicts
+
+	if len(errs) > 0 {
+		discard()
+		errs.rebase(dir, ctx.BaseDir)
+		log.Printf("config sets are not updated: %v", errs)
+		return errs
+	}
+
+	snapshot := &ProcConfigSnapshot{
+		Map: newMap,
+		LoadedAt: time.Now(),
+		Dir: dir,
+	}
+	ref := ""
+	if ctx.IsRemote {
+		snapshot.Revision, ref = ctx.Repo.Revision, ctx.Ref()
+	} else {
+		snapshot.Revision = ConfigRevision(ctx.BaseDir)
+	}
+	snapshot.HistoryID = ctx.recordHistory(snapshot.Revision, ref, newMap)
+
+	for _, set := range newMap {
+		for _, config := range set.Configs {
+			config.snapshot = snapshot
+		}
+	}
+
 	// update
-	ctx.Map = newMap
+	ctx.AcquireSnapshot(snapshot)
+	ctx.rw.Lock()
+	prev := ctx.snapshot
+	ctx.snapshot = snapshot
+	ctx.rw.Unlock()
+	ctx.ReleaseSnapshot(prev)
 
 	return nil
 }
 
-func (ctx *ProcConfigSetsContext) Find(
-	name, version		string,
-) (*PackageBuildConfig, error) {
-	if _, ok := ctx.Map[PackageName(name)]; !ok {
-		msg := fmt.Sprintf("There are no proc profiles for %s", name)
-		return nil, errors.New(msg)
+// recordHistory appends the loaded revision to the history and returns its id. Failures are only logged.
+func (ctx *ProcConfigSetsContext) recordHistory(revision, ref string, m ProcConfigMap) uint {
+	if ctx.History == nil {
+		return 0
 	}
-	configSet := ctx.Map[PackageName(name)]
 
-	if _, ok := configSet.Configs[PackageVersion(version)]; !ok {
-		msg := fmt.Sprintf("%s has no proc profile for version %s", name, version)
-		return nil, errors.New(msg)
+	h, err := ctx.History.Record(revision, ref, m)
+	if err != nil {
+		log.Printf("Failed to record the config history: %v", err)
+		return 0
 	}
 
-	return configSet.Configs[PackageVersion(version)], nil
+	return h.ID
 }
 
-func (ctx *ProcConfigSetsContext) FindWithDep(
+// CurrentHistoryID returns the id of the loaded revision (0 if it is not recorded)
+func (ctx *ProcConfigSetsContext) CurrentHistoryID() uint {
+	return ctx.Snapshot().HistoryID
+}
+
+// LastError returns the error of the last update
+func (ctx *ProcConfigSetsContext) LastError() error {
+	ctx.rw.RLock()
+	defer ctx.rw.RUnlock()
+
+	return ctx.lastError
+}
+
+func (ctx *ProcConfigSetsContext) setLastError(err error) {
+	ctx.rw.Lock()
+	defer ctx.rw.Unlock()
+
+	ctx.lastError = err
+}
+
+// ConfigErrors returns problems which are found by the last update
+func (ctx *ProcConfigSetsContext) ConfigErrors() ConfigErrors {
+	return AsConfigErrors(ctx.LastError())
+}
+
+// Find searches the config in the current snapshot
+func (ctx *ProcConfigSetsContext) Find(
+	name, version		string,
+) (*PackageBuildConfig, error) {
+	return ctx.Snapshot().Find(name, version)
+}
+
+func (ctx *ProcConfigSetsContext) FindWithDeps(
 	name, version			string,
-	depName, depVersion		string,
+	deps					DepTuple,
 	aps						*AvailablePackages,
 ) (*PackageBuildConfigWithDep, error) {
-	pkgBuildConf, err := ctx.Find(name, version)
-	if err != nil {
-		return nil, err
-	}
-
-	ap, err := aps.Find(PackageName(depName), PackageVersion(depVersion))
-	if err != nil {
-		return nil, err
-	}
+	return ctx.Snapshot().FindWithDeps(name, version, deps, aps)
+}
 
-	return &PackageBuildConfigWithDep{
-		PackageBuildConfig: pkgBuildConf,
-		DepAP: ap,
-	}, nil
+func (ctx *ProcConfigSetsContext) FindBuildConfig(
+	name, version			string,
+	depKey					string,
+	aps						*AvailablePackages,
+) (IPackageBuildConfig, error) {
+	return ctx.Snapshot().FindBuildConfig(name, version, depKey, aps)
 }
 
 func (ctx *ProcConfigSetsContext) Update() error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	err := ctx.update()
+	ctx.setLastError(err)
+
+	return err
+}
+
+// update pulls and loads config sets. If they have problems, the previous commit is checked out again,
+// so that files on the disk are the ones of the snapshot which is kept.
+func (ctx *ProcConfigSetsContext) update() error {
+	prevRevision := ""
 	if ctx.IsRemote {
+		prevRevision = ctx.Repo.Revision
 		if err := ctx.Repo.Pull(); err != nil {
+			ctx.restoreRevision(prevRevision)
 			return err
 		}
 	}
 
 	if err := ctx.Glob(); err != nil {
+		if ctx.IsRemote {
+			ctx.restoreRevision(prevRevision)
+		}
 		return err
 	}
 
 	return nil
 }
 
+func (ctx *ProcConfigSetsContext) restoreRevision(revision string) {
+	if revision == "" {
+		return
+	}
+	if err := ctx.Repo.GetRevision(); err == nil && ctx.Repo.Revision == revision {
+		return
+	}
 
-func (ctx *ProcConfigSetsContext) SortedConfigSets() []*PackageBuildConfigSet {
-	var keys []string
-    for k := range ctx.Map {
-        keys = append(keys, string(k))
-    }
-    sort.Strings(keys)
+	if err := ctx.Repo.Checkout(revision); err != nil {
+		log.Printf("Failed to restore config sets: %v", err)
+	}
+	ctx.Repo.GetRevision()
+}
 
-	var sets []*PackageBuildConfigSet
-	for _, name := range keys {
-		sets = append(sets, ctx.Map[PackageName(name)])
+// Ref returns the ref of the remote config sets which is followed now
+func (ctx *ProcConfigSetsContext) Ref() string {
+	if ctx.IsPinned() {
+		return ctx.PinnedRef.Ref
+	}
+	if ctx.DefaultRef != "" {
+		return ctx.DefaultRef
 	}
 
-	return sets
+	return defaultConfigSetsRef
+}
+
+// IsPinned returns true if the ref was switched at runtime
+func (ctx *ProcConfigSetsContext) IsPinned() bool {
+	return ctx.PinnedRef != nil && ctx.PinnedRef.Ref != ""
+}
+
+// SetRef switches the ref of the remote config sets and pins it. An empty ref resets to the ref in the config.
+// The ref is kept only when config sets at the ref are loaded without problems, otherwise the previous commit is checked out again (by update).
+func (ctx *ProcConfigSetsContext) SetRef(ref string) error {
+	if !ctx.IsRemote {
+		return errors.New("Config sets are not a remote repository")
+	}
+	if ref != "" {
+		if err := checkGitRef(ref); err != nil {
+			return err
+		}
+	}
+
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	prevPinned := ctx.PinnedRef.Ref
+
+	ctx.PinnedRef.Ref = ref
+	ctx.Repo.Ref = ctx.Ref()
+	if err := ctx.update(); err != nil {
+		ctx.PinnedRef.Ref = prevPinned
+		ctx.Repo.Ref = ctx.Ref()
+
+		return err
+	}
+	ctx.setLastError(nil)
+
+	if ctx.PinnedRef.GetFilePath() != "" {
+		if err := ctx.PinnedRef.Save(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+func (ctx *ProcConfigSetsContext) SortedConfigSets() []*PackageBuildConfigSet {
+	return ctx.Snapshot().SortedConfigSets()
 }
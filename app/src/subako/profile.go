@@ -5,6 +5,10 @@ import (
 	"sync"
 	"fmt"
 	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 
@@ -19,6 +23,8 @@ type Profile struct {
 	Compile				*ExecProfile	`json:"compile"`
 	Link				*ExecProfile	`json:"link"`
 	Exec				*ExecProfile	`json:"exec"`
+
+	AliasOf				string			`json:"alias_of,omitempty"`		// the concrete version if Version is an alias
 }
 
 func (p *Profile) Log() {
@@ -77,27 +83,116 @@ func (p propMap) has(name LanguageName, version LanguageVersion) bool {
 	return true
 }
 
+// profilesOrder sorts profiles by names, and from the newest version in each language
+type profilesOrder []Profile
+
+func (p profilesOrder) Len() int { return len(p) }
+func (p profilesOrder) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p profilesOrder) Less(i, j int) bool {
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	// aliases follow concrete versions
+	if (p[i].AliasOf == "") != (p[j].AliasOf == "") {
+		return p[i].AliasOf == ""
+	}
+	if p[i].AliasOf != "" {
+		return p[i].Version < p[j].Version
+	}
+	return CompareVersions(p[i].Version, p[j].Version) > 0
+}
+
+// makeAliasProfiles returns copies of profiles whose versions are replaced with aliases in configs.
+// Aliases which are not resolved to generated versions are skipped.
+func makeAliasProfiles(profiles []Profile, pc ProcConfigMap) []Profile {
+	// conflicts have been rejected when config sets were loaded
+	langAliases := collectLangAliases(pc, nil)
+
+	generated := make(map[string]map[string]Profile)
+	for _, prof := range profiles {
+		if _, ok := generated[prof.Name]; !ok {
+			generated[prof.Name] = make(map[string]Profile)
+		}
+		generated[prof.Name][prof.Version] = prof
+	}
+
+	aliasProfiles := make([]Profile, 0)
+	for langName, aliases := range langAliases {
+		versions := make([]string, 0)
+		for version := range generated[string(langName)] {
+			versions = append(versions, version)
+		}
+
+		for _, alias := range sortedAliasNames(aliases) {
+			version, ok := resolveAlias(aliases[alias], versions)
+			if !ok {
+				log.Printf("Alias (%s, %s) -> %s is not resolved", langName, alias, aliases[alias])
+				continue
+			}
+
+			prof := generated[string(langName)][version]
+			prof.Version = alias
+			prof.AliasOf = version
+			aliasProfiles = append(aliasProfiles, prof)
+		}
+	}
+
+	return aliasProfiles
+}
+
+// Aliases returns the map of language => alias => concrete version
+func (ph *ProfilesHolder) Aliases() map[string]map[string]string {
+	aliases := make(map[string]map[string]string)
+	for _, prof := range ph.Profiles {
+		if prof.AliasOf == "" {
+			continue
+		}
+		if _, ok := aliases[prof.Name]; !ok {
+			aliases[prof.Name] = make(map[string]string)
+		}
+		aliases[prof.Name][prof.Version] = prof.AliasOf
+	}
+
+	return aliases
+}
+
 type ProfilesHolder struct {
 	Profiles	[]Profile
+	GeneratedAt	int64		// Unix time
 
-	m			sync.Mutex	`json:"-"`	// ignore when saving
-	HasFilePath
+	changed		bool		// true if profiles have not been saved after the generation
+	storage		*Storage
+	m			sync.Mutex
 }
 
-func LoadProfilesHolder(path string) (*ProfilesHolder, error) {
-	var ph ProfilesHolder
-	if err := LoadStructure(path, &ph); err != nil {
+func LoadProfilesHolder(storage *Storage) (*ProfilesHolder, error) {
+	ph := &ProfilesHolder{
+		storage: storage,
+	}
+	if err := loadLatestProfileGeneration(storage.Db.Debug(), ph); err != nil {
 		return nil, err
 	}
 
-	return &ph, nil
+	return ph, nil
 }
 
+// Save records profiles as a new generation if they have been regenerated
 func (ph *ProfilesHolder) Save() error {
 	ph.m.Lock()
 	defer ph.m.Unlock()
 
-	return SaveStructure(ph)
+	if !ph.changed {
+		return nil
+	}
+
+	if err := ph.storage.Transaction(func(tx *gorm.DB) error {
+		return saveProfileGeneration(tx, ph)
+	}); err != nil {
+		return err
+	}
+	ph.changed = false
+
+	return nil
 }
 
 func (ph *ProfilesHolder) GenerateProcProfiles(
@@ -110,11 +205,10 @@ func (ph *ProfilesHolder) GenerateProcProfiles(
 	if err := aps.Walk(func(
 		pkgName		PackageName,
 		pkgVersion	PackageVersion,
-		depName		PackageName,
-		depVersion	PackageVersion,
+		depKey		string,
 		ap			*AvailablePackage,
 	) error {
-		log.Printf("WALK: template : package(%s, %s) dep(%s, %s)", pkgName, pkgVersion, depName, depVersion)
+		log.Printf("WALK: template : package(%s, %s) deps(%s)", pkgName, pkgVersion, depKey)
 
 		pkgBuildConfigSet, ok := pc[pkgName]
 		if !ok {
@@ -162,11 +256,11 @@ func (ph *ProfilesHolder) GenerateProcProfiles(
 	if err := aps.Walk(func(
 		pkgName		PackageName,
 		pkgVersion	PackageVersion,
-		depName		PackageName,
-		depVersion	PackageVersion,
+		depKey		string,
 		ap			*AvailablePackage,
 	) error {
-		log.Printf("WALK: patch    : package(%s, %s) dep(%s, %s)", pkgName, pkgVersion, depName, depVersion)
+		log.Printf("WALK: patch    : package(%s, %s) deps(%s)", pkgName, pkgVersion, depKey)
+		depVersion := ap.DepVersion		// patches follow the first dependency
 
 		pkgBuildConfigSet, ok := pc[pkgName]
 		if !ok {
@@ -264,8 +358,13 @@ func (ph *ProfilesHolder) GenerateProcProfiles(
 
 	log.Println("targetProfileTemplates", targetProfileTemplates)
 
+	profiles = append(profiles, makeAliasProfiles(profiles, pc)...)
+	sort.Stable(profilesOrder(profiles))
+
 	// Update
 	ph.Profiles = profiles
+	ph.GeneratedAt = time.Now().Unix()
+	ph.changed = true
 
 	return nil
 }
@@ -18,6 +18,10 @@ func readProfileTemplate(
         return nil, err
     }
 
+	if err := validateYAMLConfig("profile_template", buf, filePath); err != nil {
+		return nil, err
+	}
+
 	var pt ProfileTemplate
 	if err := yaml.Unmarshal(buf, &pt); err != nil {
 		return nil, err
@@ -73,17 +77,47 @@ func readProfilePatch(
         return nil, err
     }
 
+	if err := validateYAMLConfig("profile_patch", buf, filePath); err != nil {
+		return nil, err
+	}
+
 	var pt ProfilePatch
 	if err := yaml.Unmarshal(buf, &pt); err != nil {
 		return nil, err
 	}
 
+	if pt.From == nil || len(pt.From.Versions) == 0 {
+		return nil, errors.New("must contain 'from' section which has 'versions'")
+	}
+	if pt.To == nil || pt.To.Name == "" {
+		return nil, errors.New("must contain 'to' section which has 'name'")
+	}
+
+	pt.filePath = filePath
+
 	log.Println("ProfilePatch => ", pt)
 
 	return &pt, nil
 }
 
 
+// validateYAMLConfig checks the file against the schema before decoding it to Go types. Problems are returned as ConfigErrors.
+func validateYAMLConfig(schemaName string, buf []byte, filePath string) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return err
+	}
+
+	errs := make(ConfigErrors, 0)
+	validateConfigDocument(schemaName, doc, filePath, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+
 type IProfileTemplate interface {
 	Generate(*Profile, *AvailablePackage) error
 }
@@ -97,7 +131,7 @@ type ProfileTemplate struct {
 
 	Compile				*ExecProfileTemplate	`yaml:"compile,omitempty"`
 	Link				*ExecProfileTemplate	`yaml:"link"`
-	Exec				*ExecProfileTemplate	`yaml:"exec"`
+	Exec				*ExecProfileTemplate	`yaml:"exec" schema:"required"`
 }
 
 type ExecProfileTemplate struct {
@@ -135,22 +169,24 @@ func (template *ProfileTemplate) Generate(
 
 // ==
 type ProfilePatchFrom struct {
-	Versions			[]LanguageVersion
+	Versions			[]LanguageVersion	`schema:"required"`
 }
 
 type ProfilePatchTo struct {
-	Name				LanguageName
+	Name				LanguageName		`schema:"required"`
 	Versions			[]LanguageVersion
 }
 
 type ProfilePatch struct {
-	From				*ProfilePatchFrom
-	To					*ProfilePatchTo
+	From				*ProfilePatchFrom	`schema:"required"`
+	To					*ProfilePatchTo		`schema:"required"`
 	Append				struct {
 		Compile				*ExecProfileTemplate
 		Link				*ExecProfileTemplate
 		Exec				*ExecProfileTemplate
 	}
+
+	filePath			string
 }
 
 
@@ -0,0 +1,259 @@
+package subako
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+
+// kinds of differences between available packages and the apt repository
+const (
+	ReconcileMissingInRepo = "missing_in_repo"		// available, but not installable
+	ReconcileExtraInRepo = "extra_in_repo"			// installable, but no available packages refer it
+	ReconcileVersionMismatch = "version_mismatch"
+)
+
+// RepairDirection decides which side is trusted when differences are repaired
+type RepairDirection string
+
+const (
+	RepairToRepo = RepairDirection("repo")				// the apt repository follows available packages
+	RepairToPackages = RepairDirection("packages")		// available packages follow the apt repository
+)
+
+func ParseRepairDirection(s string) (RepairDirection, error) {
+	switch RepairDirection(s) {
+	case RepairToRepo, RepairToPackages:
+		return RepairDirection(s), nil
+	}
+
+	return "", fmt.Errorf("unknown direction %q (repo or packages)", s)
+}
+
+type ReconcileEntry struct {
+	Kind				string
+	PackageName			string		// name in the apt repository
+	Target				string		// target ID of the available package (empty if extra)
+	AvailableVersion	string
+	RepoVersion			string
+
+	pkg					*AvailablePackage
+}
+
+type ReconcileReport struct {
+	CheckedAt		time.Time
+	Entries			[]*ReconcileEntry
+
+	// filled by repairs
+	Direction		RepairDirection		`json:",omitempty"`
+	Repaired		[]string			`json:",omitempty"`
+	Failed			[]string			`json:",omitempty"`
+}
+
+func (r *ReconcileReport) IsConsistent() bool {
+	return len(r.Entries) == 0
+}
+
+type reconcileState struct {
+	last		*ReconcileReport
+	m			sync.Mutex		// also serializes repairs
+	publishM	sync.Mutex		// held while builds publish packages, so that repairs do not remove them halfway
+}
+
+
+// Reconcile compares available packages with packages in the apt repository
+func (ctx *SubakoContext) Reconcile() (*ReconcileReport, error) {
+	ctx.reconcile.m.Lock()
+	defer ctx.reconcile.m.Unlock()
+
+	return ctx.reconcileLocked()
+}
+
+func (ctx *SubakoContext) reconcileLocked() (*ReconcileReport, error) {
+	entries, err := ctx.AptRepoCtx.ListPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	// an entry is listed for each architecture
+	repoVersions := make(map[string]string)
+	for _, e := range entries {
+		repoVersions[e.Name] = e.Version
+	}
+
+	report := &ReconcileReport{
+		CheckedAt: time.Now(),
+		Entries: make([]*ReconcileEntry, 0),
+	}
+
+	referenced := make(map[string]bool)
+	for _, a := range ctx.AvailablePackages.SortedList() {
+		a := a
+		referenced[a.GeneratedPackageName] = true
+
+		repoVersion, ok := repoVersions[a.GeneratedPackageName]
+		entry := &ReconcileEntry{
+			PackageName: a.GeneratedPackageName,
+			Target: availablePackageTargetID(&a),
+			AvailableVersion: a.GeneratedPackageVersion,
+			RepoVersion: repoVersion,
+			pkg: &a,
+		}
+		switch {
+		case !ok:
+			entry.Kind = ReconcileMissingInRepo
+		case repoVersion != a.GeneratedPackageVersion:
+			entry.Kind = ReconcileVersionMismatch
+		default:
+			continue
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	extras := make([]string, 0)
+	for name := range repoVersions {
+		if !referenced[name] {
+			extras = append(extras, name)
+		}
+	}
+	sort.Strings(extras)
+	for _, name := range extras {
+		report.Entries = append(report.Entries, &ReconcileEntry{
+			Kind: ReconcileExtraInRepo,
+			PackageName: name,
+			RepoVersion: repoVersions[name],
+		})
+	}
+
+	ctx.reconcile.last = report
+
+	return report, nil
+}
+
+// LastReconcileReport returns the result of the last check or repair (nil if it has not been checked)
+func (ctx *SubakoContext) LastReconcileReport() *ReconcileReport {
+	ctx.reconcile.m.Lock()
+	defer ctx.reconcile.m.Unlock()
+
+	return ctx.reconcile.last
+}
+
+// RepairInconsistencies checks differences again, and repairs them in the direction.
+//   repo:     packages which are missing or have other versions are added from the deb if it is left,
+//             otherwise they are queued to be rebuilt. Extra packages are removed from the repository.
+//   packages: available packages which are missing are removed, and versions are updated to the repository.
+//             Extra packages cannot be repaired because there is nothing to make available packages from.
+func (ctx *SubakoContext) RepairInconsistencies(direction RepairDirection) (*ReconcileReport, error) {
+	ctx.reconcile.m.Lock()
+	defer ctx.reconcile.m.Unlock()
+
+	report, err := ctx.reconcileLocked()
+	if err != nil {
+		return nil, err
+	}
+	report.Direction = direction
+	report.Repaired = make([]string, 0)
+	report.Failed = make([]string, 0)
+
+	packagesChanged := false
+	for _, e := range report.Entries {
+		var err error
+		switch direction {
+		case RepairToRepo:
+			err = ctx.repairRepo(e)
+		case RepairToPackages:
+			err = ctx.repairPackages(e)
+			if err == nil && e.Kind != ReconcileExtraInRepo {
+				packagesChanged = true
+			}
+		}
+
+		desc := fmt.Sprintf("%s %s", e.Kind, e.PackageName)
+		if err != nil {
+			log.Printf("Reconcile: failed to repair %s / %v", desc, err)
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", desc, err))
+			continue
+		}
+		report.Repaired = append(report.Repaired, desc)
+	}
+
+	if packagesChanged {
+		if err := ctx.UpdateProfilesWithNotification(); err != nil {
+			return report, err
+		}
+	}
+
+	if len(report.Failed) > 0 {
+		ctx.Logger.Failed("Reconcile", fmt.Sprintf("repaired %d, failed %d (%s)", len(report.Repaired), len(report.Failed), direction))
+	} else {
+		ctx.Logger.Succeeded(fmt.Sprintf("Reconcile: repaired %d (%s)", len(report.Repaired), direction))
+	}
+
+	return report, nil
+}
+
+func (ctx *SubakoContext) repairRepo(e *ReconcileEntry) error {
+	switch e.Kind {
+	case ReconcileExtraInRepo:
+		return ctx.removeExtraPackage(e.PackageName)
+
+	case ReconcileMissingInRepo, ReconcileVersionMismatch:
+		a := e.pkg
+		debPath := filepath.Join(ctx.BuilderCtx.packagesDir, a.GeneratedPackageFileName)
+		if a.GeneratedPackageFileName != "" && Exists(debPath) {
+			return ctx.AptRepoCtx.AddPackage(debPath)
+		}
+
+		// debs are removed after builds
+		procConfig, err := ctx.ProcConfigSetsCtx.FindBuildConfig(string(a.Name), string(a.Version), a.DepKey, ctx.AvailablePackages)
+		if err != nil {
+			return fmt.Errorf("the deb is not found and it cannot be rebuilt: %v", err)
+		}
+		if ctx.IsQueued(procConfig) {
+			return nil
+		}
+		if err := ctx.Queue(procConfig); err != nil {
+			return err
+		}
+		ctx.Audit.Record(SystemActor("reconcile"), AuditQueue, "package", BuildConfigTargetID(procConfig), nil, nil)
+		return nil
+	}
+
+	return fmt.Errorf("unknown kind %q", e.Kind)
+}
+
+// removeExtraPackage removes the package from the apt repository unless a build has published it after the check
+func (ctx *SubakoContext) removeExtraPackage(name string) error {
+	ctx.reconcile.publishM.Lock()
+	defer ctx.reconcile.publishM.Unlock()
+
+	for _, a := range ctx.AvailablePackages.SortedList() {
+		if a.GeneratedPackageName == name {
+			return nil
+		}
+	}
+
+	return ctx.AptRepoCtx.RemovePackage(name)
+}
+
+func (ctx *SubakoContext) repairPackages(e *ReconcileEntry) error {
+	switch e.Kind {
+	case ReconcileExtraInRepo:
+		return fmt.Errorf("there is no information to make the available package")
+
+	case ReconcileMissingInRepo:
+		a := e.pkg
+		return ctx.AvailablePackages.Remove(string(a.Name), string(a.Version), a.DepKey)
+
+	case ReconcileVersionMismatch:
+		a := *e.pkg
+		a.GeneratedPackageVersion = e.RepoVersion
+		return ctx.AvailablePackages.Update(&a, nil)
+	}
+
+	return fmt.Errorf("unknown kind %q", e.Kind)
+}
@@ -1,7 +1,12 @@
 package subako
 
 import (
+	"log"
+	"os"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"encoding/json"
 )
 
@@ -12,34 +17,128 @@ type Resumable interface {
 }
 
 func LoadStructure(path string, r Resumable) error {
+	if Exists(path) || Exists(backupFilePath(path)) {
+		if err := readJSONFile(path, r); err != nil {
+			return err
+		}
+	}
+
+	// after reading, because the structure is replaced by the decoded one
 	r.SetFilePath(path)
 
-	if !Exists(path) {
+	return nil
+}
+
+func SaveStructure(r Resumable) error {
+	buffer, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.GetFilePath(), buffer); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+
+func backupFilePath(path string) string {
+	return path + ".bak"
+}
+
+// readJSONFile reads the file into v (a pointer to a struct). When the file is missing or corrupted, the backup is used instead.
+// v is replaced only by a successfully decoded value, so that nothing of the broken file is left.
+func readJSONFile(path string, v interface{}) error {
+	err := unmarshalFile(path, v)
+	if err == nil {
 		return nil
 	}
 
+	bakPath := backupFilePath(path)
+	if !Exists(bakPath) {
+		return fmt.Errorf("%s : %v", path, err)
+	}
+
+	log.Printf("Failed to load %s (%v), recover from the backup %s", path, err, bakPath)
+	if bakErr := unmarshalFile(bakPath, v); bakErr != nil {
+		return fmt.Errorf("%s : %v (backup: %v)", path, err, bakErr)
+	}
+
+	return nil
+}
+
+func unmarshalFile(path string, v interface{}) error {
 	buffer, err := ioutil.ReadFile(path)
-    if err != nil {
+	if err != nil {
 		return err
-    }
+	}
 
-	if err := json.Unmarshal(buffer, &r); err != nil {
+	// decode into a zero value, json.Unmarshal may fill v partially before it fails
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("%s : cannot decode into %T", path, v)
+	}
+	fresh := reflect.New(ptr.Type().Elem())
+	if err := json.Unmarshal(buffer, fresh.Interface()); err != nil {
 		return err
 	}
+	ptr.Elem().Set(fresh.Elem())
 
 	return nil
 }
 
-func SaveStructure(r Resumable) error {
-	buffer, err := json.Marshal(r)
+// writeFileAtomic writes data to a temporary file, syncs it and renames it to the path.
+// The previous file is kept as the backup.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	f, err := ioutil.TempFile(dir, filepath.Base(path) + ".tmp")
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(r.GetFilePath(), buffer, 0644); err != nil {
+	tmpPath := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	return nil
+	// keep the last good file
+	if Exists(path) {
+		if err := os.Rename(path, backupFilePath(path)); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
 }
 
 
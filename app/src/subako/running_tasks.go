@@ -5,6 +5,8 @@ import (
 	"sync"
 	"errors"
 	"os"
+
+	"github.com/jinzhu/gorm"
 )
 
 
@@ -17,6 +19,7 @@ const (
 	TaskFailed = RunningStatus(2)
 	TaskAborted = RunningStatus(3)
 	TaskWarning = RunningStatus(4)
+	TaskInterrupted = RunningStatus(5)	// stopped by the shutdown of Subako, will be reattached or re-queued
 )
 
 func (s RunningStatus) String() string {
@@ -31,6 +34,8 @@ func (s RunningStatus) String() string {
 		return "Aborted"
 	case TaskWarning:
 		return "Warning"
+	case TaskInterrupted:
+		return "Interrupted"
 	}
 	return ""
 }
@@ -42,7 +47,19 @@ type RunningTask struct {
 	Status				RunningStatus
 	ErrorText			string
 
-	ContainerID			*string			`json:"-"`	// ignore when saving
+	// build target
+	ProcName			PackageName
+	ProcVersion			PackageVersion
+	DepName				PackageName
+	DepVersion			PackageVersion
+	DepKey				string			// all dependencies
+	Resumed				bool			// true if the task has been reattached or re-queued after the interruption
+	ConfigHistoryID		uint			// config sets which the task was started with
+	ConfigRevision		string
+	ConfigDir			string			// the copy of config sets which the build mounts
+	SourceCommit		string			// resolved commit of the source (empty if the package has no source)
+
+	ContainerID			*string			// saved to reattach the container after the restart
 	KillContainer		*func() error	`json:"-"`	// ignore when saving
 }
 
@@ -62,8 +79,9 @@ func (rt *RunningTask) Killable() bool {
 	return rt.IsActive() && rt.ContainerID != nil && rt.KillContainer != nil
 }
 
+// Warning is used for failures after the package has been built
 func (rt *RunningTask) Warning(message string) {
-	if rt.Status == TaskRunning {
+	if rt.Status == TaskRunning || rt.Status == TaskSucceeded {
 		rt.Status = TaskWarning
 	}
 	rt.ErrorText = message
@@ -76,6 +94,20 @@ func (rt *RunningTask) Failed(message string) {
 	rt.ErrorText = message
 }
 
+func (rt *RunningTask) setTarget(c IPackageBuildConfig) {
+	rt.ProcName = c.GetName()
+	rt.ProcVersion = c.GetVersion()
+	rt.DepName = c.GetDepName()
+	rt.DepVersion = c.GetDepVersion()
+	rt.DepKey = c.GetDeps().Key()
+}
+
+// Interrupt marks the task as interrupted.
+// The container is left running so that it can be reattached after the restart.
+func (rt *RunningTask) Interrupt() {
+	rt.Status = TaskInterrupted
+}
+
 func (rt *RunningTask) Abort() error {
 	var err error
 
@@ -93,22 +125,23 @@ type RunningTasks struct {
 	Next		int
 	Tasks		[]*RunningTask
 
-	m			sync.Mutex	`json:"-"`	// ignore when saving
-	HasFilePath
+	storage		*Storage
+	m			sync.Mutex
 }
 
-func LoadRunningTasks(path string) (*RunningTasks, error) {
-	var rt RunningTasks
-	if err := LoadStructure(path, &rt); err != nil {
+func LoadRunningTasks(storage *Storage) (*RunningTasks, error) {
+	records := []taskRecord{}
+	if err := storage.Db.Debug().Order("task_id").Find(&records).Error; err != nil {
 		return nil, err
 	}
 
-	return &rt, nil
-}
-
-func (rt *RunningTasks) Save() error {
-	rt.m.Lock()
-	defer rt.m.Unlock()
+	rt := &RunningTasks{
+		Tasks: make([]*RunningTask, 0, len(records)),
+		storage: storage,
+	}
+	for _, r := range records {
+		rt.Tasks = append(rt.Tasks, r.toTask())
+	}
 
 	// throw away...
 	if len(rt.Tasks) > maxShowingTaskNum {
@@ -119,20 +152,77 @@ func (rt *RunningTasks) Save() error {
 		}
 
 		rt.Tasks = rt.Tasks[ln-maxShowingTaskNum:ln]
-		for i, task := range rt.Tasks {
-			task.Id = i
+	}
+
+	// ids are indexes of tasks
+	for i, task := range rt.Tasks {
+		task.Id = i
+	}
+	rt.Next = len(rt.Tasks)
+
+	if err := storage.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&taskRecord{}).Error; err != nil {
+			return err
+		}
+		for _, task := range rt.Tasks {
+			if err := tx.Create(makeTaskRecord(task)).Error; err != nil {
+				return err
+			}
 		}
-		rt.Next = maxShowingTaskNum
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	// kill running tasks
+	return rt, nil
+}
+
+func (rt *RunningTasks) Save() error {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	return rt.storage.Transaction(func(tx *gorm.DB) error {
+		for _, task := range rt.Tasks {
+			if err := saveTaskRecord(tx, task); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// InterruptAll interrupts all running tasks
+func (rt *RunningTasks) InterruptAll() {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	for _, task := range rt.Tasks {
+		if task.IsActive() {
+			log.Printf("interrupt the task => %d", task.Id)
+			task.Interrupt()
+		}
+	}
+}
+
+// TakeInterrupted returns tasks which should be resumed and marks them as resumed.
+// Tasks which were running when the process stopped are also treated as interrupted.
+func (rt *RunningTasks) TakeInterrupted() []*RunningTask {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	tasks := make([]*RunningTask, 0)
 	for _, task := range rt.Tasks {
 		if task.Status == TaskRunning {
-			task.Abort()
+			task.Status = TaskInterrupted
+		}
+
+		if task.Status == TaskInterrupted && !task.Resumed {
+			task.Resumed = true
+			tasks = append(tasks, task)
 		}
 	}
 
-	return SaveStructure(rt)
+	return tasks
 }
 
 func (rt *RunningTasks) createTaskHolder() *RunningTask {
@@ -161,6 +251,50 @@ func (rt *RunningTasks) Get(id int) *RunningTask {
 	return rt.Tasks[id]
 }
 
+func (rt *RunningTasks) CountActive() int {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	num := 0
+	for _, task := range rt.Tasks {
+		if task.IsActive() {
+			num++
+		}
+	}
+
+	return num
+}
+
+// FindByConfigHistory returns tasks which were started with the revision of config sets
+func (rt *RunningTasks) FindByConfigHistory(id uint) []*RunningTask {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	tasks := make([]*RunningTask, 0)
+	for _, task := range rt.Tasks {
+		if task.ConfigHistoryID == id {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks
+}
+
+// LatestByTarget returns the last task which built the target (nil if there are no tasks)
+func (rt *RunningTasks) LatestByTarget(name PackageName, version PackageVersion, depKey string) *RunningTask {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	for i := len(rt.Tasks) - 1; i >= 0; i-- {
+		task := rt.Tasks[i]
+		if task != nil && task.ProcName == name && task.ProcVersion == version && task.DepKey == depKey {
+			return task
+		}
+	}
+
+	return nil
+}
+
 func (rt *RunningTasks) MakeDisplayTask() []*RunningTask {
 	rt.m.Lock()
 	defer rt.m.Unlock()
@@ -0,0 +1,303 @@
+package subako
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"reflect"
+)
+
+
+// Schema is a JSON Schema (draft-07) document
+type Schema map[string]interface{}
+
+const schemaDialect = "http://json-schema.org/draft-07/schema#"
+
+type schemaFormat int
+const (
+	schemaJSON = schemaFormat(0)	// keys are taken from json tags
+	schemaYAML = schemaFormat(1)	// keys are taken from yaml tags or lower-cased field names
+)
+
+type configSchemaDef struct {
+	title		string
+	fileName	string
+	format		schemaFormat
+	t			reflect.Type
+}
+
+var configSchemaDefs = map[string]configSchemaDef{
+	"package_config": {"Package config", "package_config.json", schemaJSON, reflect.TypeOf(PackageBuildConfigSet{})},
+	"lang_config": {"Language config", "config.json", schemaJSON, reflect.TypeOf(LangConfigSet{})},
+	"profile_template": {"Profile template", "profile_templates/template.yml", schemaYAML, reflect.TypeOf(ProfileTemplate{})},
+	"profile_patch": {"Profile patch", "profile_templates/patch_*.yml", schemaYAML, reflect.TypeOf(ProfilePatch{})},
+}
+
+// ConfigSchemaNames returns names of schemas of config formats
+func ConfigSchemaNames() []string {
+	names := make([]string, 0, len(configSchemaDefs))
+	for name, _ := range configSchemaDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ConfigSchema generates the schema from Go types
+func ConfigSchema(name string) (Schema, error) {
+	def, ok := configSchemaDefs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown schema: %s", name)
+	}
+
+	schema := typeSchema(def.t, def.format)
+	schema["$schema"] = schemaDialect
+	schema["$id"] = "/schemas/" + name + ".json"
+	schema["title"] = def.title
+	schema["description"] = def.fileName
+
+	return schema, nil
+}
+
+func mustConfigSchema(name string) Schema {
+	schema, err := ConfigSchema(name)
+	if err != nil {
+		panic(err)	// only for names in configSchemaDefs
+	}
+
+	return schema
+}
+
+
+// fieldKey returns the key of the field in the file. Empty means that the field is not read from files.
+func fieldKey(f reflect.StructField, format schemaFormat) string {
+	if f.PkgPath != "" {
+		return ""	// unexported
+	}
+
+	switch format {
+	case schemaJSON:
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			return ""
+		}
+		return tag		// fields without json tags hold loaded results
+
+	case schemaYAML:
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if tag == "-" {
+			return ""
+		}
+		if tag == "" {
+			return strings.ToLower(f.Name)	// default of yaml.v2
+		}
+		return tag
+	}
+
+	return ""
+}
+
+func typeSchema(t reflect.Type, format schemaFormat) Schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), format)
+
+	case reflect.String:
+		return Schema{"type": "string"}
+
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Schema{"type": "integer"}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer", "minimum": 0}
+
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+
+	case reflect.Slice, reflect.Array:
+		return Schema{
+			"type": "array",
+			"items": typeSchema(t.Elem(), format),
+		}
+
+	case reflect.Map:
+		return Schema{
+			"type": "object",
+			"additionalProperties": typeSchema(t.Elem(), format),
+		}
+
+	case reflect.Struct:
+		properties := Schema{}
+		required := make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := fieldKey(f, format)
+			if key == "" {
+				continue
+			}
+
+			properties[key] = typeSchema(f.Type, format)
+			if f.Tag.Get("schema") == "required" {
+				required = append(required, key)
+			}
+		}
+
+		schema := Schema{
+			"type": "object",
+			"properties": properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+
+	return Schema{}
+}
+
+
+// validateConfigDocument checks the decoded document of the config file against the schema of the name
+func validateConfigDocument(name string, doc interface{}, filePath string, errs *ConfigErrors) {
+	if doc == nil {
+		errs.add(filePath, "", "must not be empty")
+		return
+	}
+
+	validateSchema(mustConfigSchema(name), configSchemaDefs[name].format, doc, "", errs, filePath)
+}
+
+// validateSchema checks the decoded document (JSON or YAML) against the schema.
+// Problems are appended to errs with the field path.
+func validateSchema(schema Schema, format schemaFormat, v interface{}, field string, errs *ConfigErrors, filePath string) {
+	if v == nil {
+		return		// null is treated as an omitted value
+	}
+
+	switch schema["type"] {
+	case "string":
+		if _, ok := v.(string); !ok && !(format == schemaYAML && isYAMLScalar(v)) {
+			errs.add(filePath, field, "must be a string")
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs.add(filePath, field, "must be a boolean")
+		}
+
+	case "integer", "number":
+		n, ok := toFloat(v)
+		if !ok {
+			errs.add(filePath, field, "must be a number")
+			return
+		}
+		if schema["type"] == "integer" && n != float64(int64(n)) {
+			errs.add(filePath, field, "must be an integer")
+		}
+		if min, ok := schema["minimum"]; ok && n < float64(min.(int)) {
+			errs.add(filePath, field, "must be >= %v", min)
+		}
+
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			errs.add(filePath, field, "must be an array")
+			return
+		}
+		for i, item := range items {
+			validateSchema(schema["items"].(Schema), format, item, fmt.Sprintf("%s[%d]", field, i), errs, filePath)
+		}
+
+	case "object":
+		obj, ok := toObject(v)
+		if !ok {
+			errs.add(filePath, field, "must be an object")
+			return
+		}
+
+		properties, _ := schema["properties"].(Schema)
+		if required, ok := schema["required"].([]string); ok {
+			for _, key := range required {
+				if _, ok := obj[key]; !ok {
+					errs.add(filePath, joinField(field, key), "is required")
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key, _ := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if p, ok := properties[key]; ok {
+				validateSchema(p.(Schema), format, obj[key], joinField(field, key), errs, filePath)
+				continue
+			}
+
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					errs.add(filePath, joinField(field, key), "unknown key")
+				}
+			case Schema:
+				validateSchema(additional, format, obj[key], joinField(field, key), errs, filePath)
+			}
+		}
+	}
+}
+
+// isYAMLScalar returns true for unquoted scalars (Ex. versions: [3.8, 6]), which yaml.v2 decodes into strings
+func isYAMLScalar(v interface{}) bool {
+	switch v.(type) {
+	case int, int64, uint64, float64, bool:
+		return true
+	}
+
+	return false
+}
+
+func joinField(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+
+	return parent + "." + key
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+// toObject accepts both of JSON objects and YAML mappings
+func toObject(v interface{}) (map[string]interface{}, bool) {
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		return obj, true
+
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for k, v := range obj {
+			result[fmt.Sprintf("%v", k)] = v
+		}
+		return result, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,374 @@
+package subako
+
+import (
+	"log"
+	"fmt"
+	"time"
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+)
+
+
+// Storage is the database which holds available packages, tasks and profile generations
+type Storage struct {
+	Db		gorm.DB
+}
+
+// JSONStatePaths are files which were used to save states before the database.
+// They are imported only once by the migration.
+type JSONStatePaths struct {
+	AvailablePackagesPath	string
+	RunningTasksPath		string
+	ProfilesHolderPath		string
+}
+
+type SchemaMigration struct {
+	Version		int			`gorm:"primary_key"`
+	Description	string
+	AppliedAt	time.Time
+}
+
+type storageMigration struct {
+	version		int
+	description	string
+	f			func(tx *gorm.DB) error
+}
+
+func MakeStorage(db gorm.DB, legacy *JSONStatePaths) (*Storage, error) {
+	s := &Storage{
+		Db: db,
+	}
+
+	if err := s.migrate(s.migrations(legacy)); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrations must be only appended. Applied versions are recorded to the schema_migrations table.
+func (s *Storage) migrations(legacy *JSONStatePaths) []storageMigration {
+	return []storageMigration{
+		{1, "create packages, tasks and profile generations", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&packageRecord{}, &taskRecord{}, &profileGeneration{}).Error
+		}},
+		{2, "add unique index to packages", func(tx *gorm.DB) error {
+			return tx.Model(&packageRecord{}).AddUniqueIndex("idx_package_records_key", "name", "version", "dep_name", "dep_version").Error
+		}},
+		{3, "import JSON state files", func(tx *gorm.DB) error {
+			return importJSONStates(tx, legacy)
+		}},
+		{4, "add config revisions to tasks", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&taskRecord{}).Error
+		}},
+		{5, "add config fingerprints to packages", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&packageRecord{}).Error
+		}},
+		{6, "add config revision hashes to tasks", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&taskRecord{}).Error
+		}},
+		{7, "add source commits to packages and tasks", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&packageRecord{}, &taskRecord{}).Error
+		}},
+		{8, "key packages and tasks by dependency tuples", func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&packageRecord{}, &taskRecord{}).Error; err != nil {
+				return err
+			}
+			// records so far have one dependency at most (new columns are NULL)
+			for _, table := range []string{"package_records", "task_records"} {
+				if err := tx.Exec("UPDATE " + table + " SET dep_key = CASE WHEN dep_name != '' THEN dep_name || '/' || dep_version ELSE '' END WHERE dep_key IS NULL OR dep_key = ''").Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_package_records_key").Error; err != nil {
+				return err
+			}
+			return tx.Model(&packageRecord{}).AddUniqueIndex("idx_package_records_dep_key", "name", "version", "dep_key").Error
+		}},
+		{9, "add orphan marks to packages", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&packageRecord{}).Error
+		}},
+		{10, "add config dirs to tasks", func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&taskRecord{}).Error
+		}},
+		{11, "reset config fingerprints which covered lists of versions", func(tx *gorm.DB) error {
+			// they are not comparable with new ones, and all packages would be rebuilt
+			return tx.Exec("UPDATE package_records SET config_fingerprint = ''").Error
+		}},
+	}
+}
+
+func (s *Storage) migrate(migrations []storageMigration) error {
+	if err := s.Db.Debug().AutoMigrate(&SchemaMigration{}).Error; err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		count := 0
+		s.Db.Debug().Model(&SchemaMigration{}).Where("version = ?", m.version).Count(&count)
+		if count > 0 {
+			continue	// already applied
+		}
+
+		log.Printf("Migrate the database => %d: %s", m.version, m.description)
+		if err := s.Transaction(func(tx *gorm.DB) error {
+			if err := m.f(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaMigration{
+				Version: m.version,
+				Description: m.description,
+				AppliedAt: time.Now(),
+			}).Error
+		}); err != nil {
+			return fmt.Errorf("Failed to migrate the database (%d: %s): %v", m.version, m.description, err)
+		}
+	}
+
+	return nil
+}
+
+// Transaction runs f in a transaction. Changes are rolled back when f returns an error.
+func (s *Storage) Transaction(f func(tx *gorm.DB) error) error {
+	tx := s.Db.Debug().Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+
+type packageRecord struct {
+	ID					uint	`gorm:"primary_key"`
+	AvailablePackage
+	UpdatedAt			time.Time
+}
+
+func savePackageRecord(tx *gorm.DB, a *AvailablePackage) error {
+	a.normalizeDepKey()
+	if err := deletePackageRecord(tx, a.Name, a.Version, a.DepKey); err != nil {
+		return err
+	}
+
+	return tx.Create(&packageRecord{
+		AvailablePackage: *a,
+	}).Error
+}
+
+func deletePackageRecord(
+	tx					*gorm.DB,
+	name				PackageName,
+	version				PackageVersion,
+	depKey				string,
+) error {
+	return tx.Where(
+		"name = ? AND version = ? AND dep_key = ?",
+		string(name), string(version), depKey,
+	).Delete(&packageRecord{}).Error
+}
+
+
+type taskRecord struct {
+	ID				uint	`gorm:"primary_key"`
+	TaskID			int		`sql:"unique"`
+	LogName			string
+	LogFilePath		string
+	Status			RunningStatus
+	ErrorText		string	`sql:"type:text"`
+
+	ProcName		PackageName
+	ProcVersion		PackageVersion
+	DepName			PackageName
+	DepVersion		PackageVersion
+	DepKey			string
+	Resumed			bool
+	ConfigHistoryID	uint
+	ConfigRevision	string
+	ConfigDir		string
+	SourceCommit	string
+
+	ContainerID		string
+}
+
+func makeTaskRecord(t *RunningTask) *taskRecord {
+	r := &taskRecord{
+		TaskID: t.Id,
+		LogName: t.LogName,
+		LogFilePath: t.LogFilePath,
+		Status: t.Status,
+		ErrorText: t.ErrorText,
+		ProcName: t.ProcName,
+		ProcVersion: t.ProcVersion,
+		DepName: t.DepName,
+		DepVersion: t.DepVersion,
+		DepKey: t.DepKey,
+		Resumed: t.Resumed,
+		ConfigHistoryID: t.ConfigHistoryID,
+		ConfigRevision: t.ConfigRevision,
+		ConfigDir: t.ConfigDir,
+		SourceCommit: t.SourceCommit,
+	}
+	if t.ContainerID != nil {
+		r.ContainerID = *t.ContainerID
+	}
+
+	return r
+}
+
+func (r *taskRecord) toTask() *RunningTask {
+	t := &RunningTask{
+		Id: r.TaskID,
+		LogName: r.LogName,
+		LogFilePath: r.LogFilePath,
+		Status: r.Status,
+		ErrorText: r.ErrorText,
+		ProcName: r.ProcName,
+		ProcVersion: r.ProcVersion,
+		DepName: r.DepName,
+		DepVersion: r.DepVersion,
+		DepKey: r.DepKey,
+		Resumed: r.Resumed,
+		ConfigHistoryID: r.ConfigHistoryID,
+		ConfigRevision: r.ConfigRevision,
+		ConfigDir: r.ConfigDir,
+		SourceCommit: r.SourceCommit,
+	}
+	if r.ContainerID != "" {
+		containerID := r.ContainerID
+		t.ContainerID = &containerID
+	}
+
+	return t
+}
+
+func saveTaskRecord(tx *gorm.DB, t *RunningTask) error {
+	if err := tx.Where("task_id = ?", t.Id).Delete(&taskRecord{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Create(makeTaskRecord(t)).Error
+}
+
+
+const maxProfileGenerations = 10
+
+type profileGeneration struct {
+	ID				uint	`gorm:"primary_key"`
+	GeneratedAt		int64	// Unix time
+	Profiles		string	`sql:"type:text"`	// JSON
+}
+
+func saveProfileGeneration(tx *gorm.DB, ph *ProfilesHolder) error {
+	buffer, err := json.Marshal(ph.Profiles)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Create(&profileGeneration{
+		GeneratedAt: ph.GeneratedAt,
+		Profiles: string(buffer),
+	}).Error; err != nil {
+		return err
+	}
+
+	// keep only recent generations
+	ids := []uint{}
+	tx.Model(&profileGeneration{}).Order("id desc").Offset(maxProfileGenerations).Pluck("id", &ids)
+	if len(ids) > 0 {
+		return tx.Where("id IN (?)", ids).Delete(&profileGeneration{}).Error
+	}
+
+	return nil
+}
+
+func loadLatestProfileGeneration(db *gorm.DB, ph *ProfilesHolder) error {
+	gen := profileGeneration{}
+	if err := db.Order("id desc").First(&gen).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			return nil	// not generated yet
+		}
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(gen.Profiles), &ph.Profiles); err != nil {
+		return err
+	}
+	ph.GeneratedAt = gen.GeneratedAt
+
+	return nil
+}
+
+
+// importJSONStates imports JSON files which were used by old versions
+func importJSONStates(tx *gorm.DB, legacy *JSONStatePaths) error {
+	if legacy == nil {
+		return nil
+	}
+
+	imported := make([]string, 0)
+
+	// available packages
+	if path := legacy.AvailablePackagesPath; path != "" && (Exists(path) || Exists(backupFilePath(path))) {
+		// name => version => dep name => dep version
+		var ap struct {
+			Packages	map[PackageName]map[PackageVersion]map[PackageName]map[PackageVersion]AvailablePackage
+		}
+		if err := readJSONFile(path, &ap); err != nil {
+			return err
+		}
+		for _, verMap := range ap.Packages {
+			for _, depNameMap := range verMap {
+				for _, depVerMap := range depNameMap {
+					for _, pkg := range depVerMap {
+						if err := savePackageRecord(tx, &pkg); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		imported = append(imported, path)
+	}
+
+	// running tasks
+	if path := legacy.RunningTasksPath; path != "" && (Exists(path) || Exists(backupFilePath(path))) {
+		var rt struct {
+			Tasks		[]*RunningTask
+		}
+		if err := readJSONFile(path, &rt); err != nil {
+			return err
+		}
+		for _, task := range rt.Tasks {
+			if err := saveTaskRecord(tx, task); err != nil {
+				return err
+			}
+		}
+		imported = append(imported, path)
+	}
+
+	// profiles
+	if path := legacy.ProfilesHolderPath; path != "" && (Exists(path) || Exists(backupFilePath(path))) {
+		var ph ProfilesHolder
+		if err := readJSONFile(path, &ph); err != nil {
+			return err
+		}
+		if err := saveProfileGeneration(tx, &ph); err != nil {
+			return err
+		}
+		imported = append(imported, path)
+	}
+
+	for _, path := range imported {
+		log.Printf("Imported => %s (it is not used anymore)", path)
+	}
+
+	return nil
+}
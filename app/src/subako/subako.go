@@ -3,10 +3,12 @@ package subako
 import (
 	"log"
 	"os"
+	"io"
 	"time"
 	"path/filepath"
 	"fmt"
 	"sync"
+	"errors"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
@@ -16,7 +18,7 @@ import (
 
 type SubakoConfig struct {
 	ProcConfigSetsConf		*ProcConfigSetsConfig
-	AvailablePackagesPath	string
+	AvailablePackagesPath	string		// imported to the database once
 	AptRepositoryBaseDir	string
 
 	VirtualUsrDir			string
@@ -25,19 +27,33 @@ type SubakoConfig struct {
 	PackagePrefix			string
 	InstallBasePrefix		string
 
-	RunningTasksPath		string
-	ProfilesHolderPath		string
+	RunningTasksPath		string		// imported to the database once
+	QueuedTasksPath			string
+	ProfilesHolderPath		string		// imported to the database once
 	DataBasePath			string
 	NotificationConf		*NotificationConfig
 	CronData				Crontab
 	LogDir					string
+
+	StorageDir				string
+	MinFreeDiskBytes		uint64		// used by the readiness check
+	AutosaveInterval		time.Duration
+	OrphanCheckInterval		time.Duration
+
+	WatchConfigSets			bool			// reload local config sets when files are changed
+	ConfigWatchDebounce		time.Duration
 }
 
 
 type QueueTask struct {
-	Proc	IPackageBuildConfig
+	Proc			IPackageBuildConfig
+	SourceCommit	string		// resolved when it is queued (empty: resolved when it is built)
 }
 
+var ErrShuttingDown = errors.New("Subako is shutting down")
+
+const defaultAutosaveInterval = 1 * time.Minute
+
 
 type SubakoContext struct {
 	AptRepoCtx			*AptRepositoryContext
@@ -49,11 +65,28 @@ type SubakoContext struct {
 	Webhooks			*WebhookContext
 	NotificationCtx		*NotificationContext
 	DailyTasks			*DailyTasksContext
+	Users				*UsersContext
+	ApiTokens			*ApiTokensContext
+	Audit				*AuditLogContext
+	Storage				*Storage
+	Metrics				*Metrics
 	LogDir				string
 	Logger				IMiniLogger		// mini logger
 
-	queueCh				chan QueueTask
-	QueueHelper			[]QueueTask
+	StorageDir			string
+	MinFreeDiskBytes	uint64
+	db					gorm.DB
+
+	queueSignal			chan struct{}		// wakes the worker up when tasks are appended to QueueHelper
+	QueueHelper			[]QueueTask			// not bounded, so that queueing never waits for builds
+	pendingQueue		*PendingQueue
+
+	cron				*cron.Cron
+	configWatcher		*ConfigWatcher
+	orphanCheck			orphanCheckState
+	reconcile			reconcileState
+	closing				bool			// true when new tasks are not accepted
+	building			sync.WaitGroup
 
 	m					sync.Mutex
 }
@@ -65,6 +98,18 @@ func MakeSubakoContext(config *SubakoConfig) (*SubakoContext, error) {
 		panic(err)
 	}
 
+	db.AutoMigrate(&healthProbe{})
+
+	// storage
+	storage, err := MakeStorage(db, &JSONStatePaths{
+		AvailablePackagesPath: config.AvailablePackagesPath,
+		RunningTasksPath: config.RunningTasksPath,
+		ProfilesHolderPath: config.ProfilesHolderPath,
+	})
+	if err != nil {
+		panic(err)
+	}
+
 	// logger
 	miniLogger, err := MakeMiniLogger(db)
 	if err != nil {
@@ -90,25 +135,36 @@ func MakeSubakoContext(config *SubakoConfig) (*SubakoContext, error) {
 	}
 
 	// Config Sets
-	procConfigSetsCtx, err := MakeProcConfigSetsContext(config.ProcConfigSetsConf)
+	configHistory, err := MakeConfigHistoryContext(db)
+	if err != nil {
+		panic(err)
+	}
+
+	procConfigSetsCtx, err := MakeProcConfigSetsContext(config.ProcConfigSetsConf, configHistory)
 	if err != nil {
 		panic(err)
 	}
 
 	// Available Packages
-	availablePackages, err := LoadAvailablePackages(config.AvailablePackagesPath)
+	availablePackages, err := LoadAvailablePackages(storage)
 	if err != nil {
 		panic(err)
 	}
 
 	// running tasks
-	runningTasks, err := LoadRunningTasks(config.RunningTasksPath)
+	runningTasks, err := LoadRunningTasks(storage)
+	if err != nil {
+		panic(err)
+	}
+
+	// tasks which were queued at the last shutdown
+	pendingQueue, err := LoadPendingQueue(config.QueuedTasksPath)
 	if err != nil {
 		panic(err)
 	}
 
 	// profiles holder
-	profiles, err := LoadProfilesHolder(config.ProfilesHolderPath)
+	profiles, err := LoadProfilesHolder(storage)
 	if err != nil {
 		panic(err)
 	}
@@ -131,6 +187,24 @@ func MakeSubakoContext(config *SubakoConfig) (*SubakoContext, error) {
 		panic(err)
 	}
 
+	// users
+	users, err := MakeUsersContext(db)
+	if err != nil {
+		panic(err)
+	}
+
+	// api tokens
+	apiTokens, err := MakeApiTokensContext(db, users)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit log
+	audit, err := MakeAuditLogContext(db)
+	if err != nil {
+		panic(err)
+	}
+
 	// make context
 	ctx := &SubakoContext{
 		AptRepoCtx: aptRepo,
@@ -142,15 +216,52 @@ func MakeSubakoContext(config *SubakoConfig) (*SubakoContext, error) {
 		Webhooks: webhooks,
 		NotificationCtx: notificationCtx,
 		DailyTasks: dailyTasks,
+		Users: users,
+		ApiTokens: apiTokens,
+		Audit: audit,
+		Storage: storage,
 		LogDir: config.LogDir,
 		Logger: miniLogger,
 
-		queueCh: make(chan QueueTask, 100),
+		StorageDir: config.StorageDir,
+		MinFreeDiskBytes: func() uint64 {
+			if config.MinFreeDiskBytes == 0 {
+				return defaultMinFreeDiskBytes
+			}
+			return config.MinFreeDiskBytes
+		}(),
+		db: db,
+
+		queueSignal: make(chan struct{}, 1),
 		QueueHelper: make([]QueueTask, 0, 100),
+		pendingQueue: pendingQueue,
+	}
+
+	// metrics
+	metrics, err := MakeMetrics(ctx)
+	if err != nil {
+		panic(err)
 	}
+	ctx.Metrics = metrics
 
 	go ctx.execQueuedTask()
 
+	// resume tasks which were stopped by the last shutdown
+	ctx.restoreTasks()
+
+	// states are also saved when they are changed
+	autosaveInterval := config.AutosaveInterval
+	if autosaveInterval == 0 {
+		autosaveInterval = defaultAutosaveInterval
+	}
+	go ctx.autosave(autosaveInterval)
+
+	orphanCheckInterval := config.OrphanCheckInterval
+	if orphanCheckInterval == 0 {
+		orphanCheckInterval = defaultOrphanCheckInterval
+	}
+	go ctx.checkOrphansPeriodically(orphanCheckInterval)
+
 	// cron
 	cronText := fmt.Sprintf("00 %02d %02d * * *", config.CronData.Minute, config.CronData.Hour)
 	c := cron.New()
@@ -158,32 +269,159 @@ func MakeSubakoContext(config *SubakoConfig) (*SubakoContext, error) {
 	c.AddFunc(cronText, func() { ctx.queueDailyTask() })
 	// c.AddFunc("10 * * * * *", func() { ctx.queueDailyTask() })	// test
 	c.Start()
+	ctx.cron = c
+
+	// watcher
+	if config.WatchConfigSets {
+		if procConfigSetsCtx.IsRemote {
+			log.Println("Config sets are remote, watching is ignored")
+		} else {
+			watcher, err := MakeConfigWatcher(procConfigSetsCtx.BaseDir, config.ConfigWatchDebounce, ctx.reloadWatchedConfigSets)
+			if err != nil {
+				panic(err)
+			}
+			ctx.configWatcher = watcher
+		}
+	}
 
 	return ctx, nil
 }
 
+// reloadWatchedConfigSets is called by the watcher. Config sets which have problems are not used.
+func (ctx *SubakoContext) reloadWatchedConfigSets() {
+	if ctx.isClosing() {
+		return
+	}
+
+	log.Println("Config sets are changed, reloading")
+	if err := ctx.RefreshProfileConfigs(); err != nil {
+		log.Printf("Failed to reload config sets: %v", err)
+		return
+	}
+	ctx.Audit.Record(SystemActor("config_watcher"), AuditConfigReload, "config_sets", "", nil, map[string]interface{}{
+		"packages": len(ctx.ProcConfigSetsCtx.Snapshot().Map),
+	})
+}
+
+
+func (ctx *SubakoContext) findBuildConfig(key QueueTaskKey) (IPackageBuildConfig, error) {
+	return ctx.ProcConfigSetsCtx.FindBuildConfig(
+		string(key.Name),
+		string(key.Version),
+		key.depKey(),
+		ctx.AvailablePackages,
+	)
+}
+
+// restoreTasks reattaches containers of interrupted tasks which are still alive,
+// and re-queues other interrupted tasks and tasks which were waiting in the queue
+func (ctx *SubakoContext) restoreTasks() {
+	keys := make([]QueueTaskKey, 0)
+	for _, task := range ctx.RunningTasks.TakeInterrupted() {
+		key := QueueTaskKey{
+			Name: task.ProcName,
+			Version: task.ProcVersion,
+			DepName: task.DepName,
+			DepVersion: task.DepVersion,
+			DepKey: task.DepKey,
+		}
+
+		if task.ContainerID != nil && ctx.BuilderCtx.containerExists(*task.ContainerID) {
+			procConfig, err := ctx.findBuildConfig(key)
+			if err == nil {
+				log.Printf("reattach the task => %d (%s)", task.Id, *task.ContainerID)
+				if ctx.startBuilding() {
+					// the container still mounts the copy of config sets
+					ctx.ProcConfigSetsCtx.retainDir(task.ConfigDir)
+					go ctx.resumeBuild(procConfig, task)
+				}
+				continue
+			}
+			ctx.Logger.Failed("RestoreTasks", err.Error())
+		}
+
+		keys = append(keys, key)
+	}
+	keys = append(keys, ctx.pendingQueue.Tasks...)
+	ctx.pendingQueue.Tasks = nil
+
+	// tasks in the queue are built with the current snapshot
+	ctx.ProcConfigSetsCtx.removeUnusedSnapshotDirs()
+
+	for _, key := range keys {
+		if key.Name == "" {
+			continue	// saved by old versions
+		}
+
+		procConfig, err := ctx.findBuildConfig(key)
+		if err != nil {
+			ctx.Logger.Failed("RestoreTasks", err.Error())
+			continue
+		}
+
+		if err := ctx.Queue(procConfig); err != nil {
+			ctx.Logger.Failed("RestoreTasks", err.Error())
+			continue
+		}
+	}
+}
+
 
 func (ctx *SubakoContext) BuildAsync(
 	taskConfig			IPackageBuildConfig,
-) *RunningTask {
+) (*RunningTask, error) {
 	log.Println("Build Async: enter")
 	defer log.Println("Build Async: leave")
 
+	if !ctx.startBuilding() {
+		return nil, ErrShuttingDown
+	}
+
+	ctx.ProcConfigSetsCtx.AcquireSnapshot(taskConfig.GetSnapshot())
 	task := ctx.RunningTasks.createTaskHolder()
-	go ctx.Build(taskConfig, task)
+	ctx.persist("RunningTasks", ctx.RunningTasks.Save)
+	go ctx.Build(taskConfig, "", task)
 
-	return task
+	return task, nil
 }
 
+// Build runs the task. Callers must count it by ctx.building before calling (see startBuilding),
+// and acquire the snapshot of the config, which is released when the build finishes.
 func (ctx *SubakoContext) Build(
 	taskConfig			IPackageBuildConfig,
+	sourceCommit		string,			// empty if it has not been resolved
 	task				*RunningTask,
 ) *RunningTask {
 	if task == nil {
 		task = ctx.RunningTasks.createTaskHolder()
 	}
 
+	defer ctx.building.Done()
+
 	task.Status = TaskRunning
+	task.setTarget(taskConfig)
+	task.ConfigDir = ctx.ProcConfigSetsCtx.BaseDir
+	if snapshot := taskConfig.GetSnapshot(); snapshot != nil {
+		defer ctx.ProcConfigSetsCtx.ReleaseSnapshot(snapshot)
+
+		task.ConfigHistoryID = snapshot.HistoryID
+		task.ConfigRevision = snapshot.Revision
+		if snapshot.Dir != "" {
+			task.ConfigDir = snapshot.Dir
+		}
+	}
+	if source := taskConfig.GetSource(); source != nil {
+		if sourceCommit == "" {
+			// built without the commit if the remote is unavailable
+			commit, err := source.ResolveCommit()
+			if err != nil {
+				log.Printf("Failed to resolve the source of %s / %v", BuildConfigTargetID(taskConfig), err)
+				ctx.Logger.Failed(fmt.Sprintf("Failed to resolve the source: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), err.Error())
+			}
+			sourceCommit = commit
+		}
+		task.SourceCommit = sourceCommit
+	}
 
 	logName := fmt.Sprintf("%s-%s-%s", taskConfig.GetName(), taskConfig.GetVersion(), time.Now().Format("2006-01-02 15:04:05 MST"))
 	task.LogName = logName
@@ -194,6 +432,7 @@ func (ctx *SubakoContext) Build(
 	if err != nil {
 		log.Printf("Failed to openfile %s", logFilePath)
 		task.Failed("failed to open log reciever")
+		ctx.Metrics.observeBuild(taskConfig.GetName(), task, 0)
 
 		return task
 	}
@@ -206,8 +445,62 @@ func (ctx *SubakoContext) Build(
 		log.Printf("Got Container information: %v", ici)
 		task.ContainerID = &ici.ContainerID
 		task.KillContainer = &ici.KillContainerFunc
+
+		// save the container to reattach it even if Subako crashes
+		ctx.persist("RunningTasks", ctx.RunningTasks.Save)
 	}()
-	result, err := ctx.BuilderCtx.build(taskConfig, ctx.ProcConfigSetsCtx.BaseDir, w, ch)
+	result, err := ctx.BuilderCtx.build(taskConfig, task.ConfigDir, task.SourceCommit, w, ch)
+	ctx.finishBuild(taskConfig, task, w, result, err)
+
+	return task
+}
+
+// resumeBuild waits for the container of the task which was started before the restart
+func (ctx *SubakoContext) resumeBuild(
+	taskConfig			IPackageBuildConfig,
+	task				*RunningTask,
+) {
+	defer ctx.building.Done()
+	defer ctx.ProcConfigSetsCtx.releaseDir(task.ConfigDir)	// retained by restoreTasks
+
+	containerID := *task.ContainerID
+	killContainer := ctx.BuilderCtx.makeKillContainerFunc(containerID)
+	task.KillContainer = &killContainer
+	task.Resumed = false	// can be resumed again if Subako is restarted during the build
+	task.Status = TaskRunning
+
+	// all logs are written again from the beginning of the container
+	w, err := os.OpenFile(task.LogFilePath, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("Failed to openfile %s", task.LogFilePath)
+		task.Failed("failed to open log reciever")
+		ctx.Metrics.observeBuild(taskConfig.GetName(), task, 0)
+
+		return
+	}
+	defer w.Close()
+
+	result, err := ctx.BuilderCtx.reattach(containerID, taskConfig, w)
+	ctx.finishBuild(taskConfig, task, w, result, err)
+}
+
+// finishBuild does steps after the build in the container (packages, repository, notification, profiles and dependencies)
+func (ctx *SubakoContext) finishBuild(
+	taskConfig			IPackageBuildConfig,
+	task				*RunningTask,
+	w					io.Writer,
+	result				*BuildResult,
+	err					error,
+) {
+	var duration time.Duration
+	defer func() {
+		ctx.Metrics.observeBuild(taskConfig.GetName(), task, duration)
+		ctx.persist("RunningTasks", ctx.RunningTasks.Save)
+	}()
+
+	if err == nil {
+		duration = result.duration
+	}
 	if err != nil {
 		log.Printf("Failed to build / %v", err)
 		task.Failed(err.Error())
@@ -216,10 +509,23 @@ func (ctx *SubakoContext) Build(
 
 		ctx.Logger.Failed(fmt.Sprintf("Failed to build: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
 
-		return task
+		return
+	}
+
+	// update repository and available packages without repairs of reconcile between them
+	ctx.reconcile.publishM.Lock()
+
+	debPath := filepath.Join(ctx.BuilderCtx.packagesDir, result.PkgFileName)
+	if err := ctx.AptRepoCtx.AddPackage(debPath); err != nil {
+		ctx.reconcile.publishM.Unlock()
+		task.Failed(err.Error())
+
+		ctx.Logger.Failed(fmt.Sprintf("Failed to update repo: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
+
+		return
 	}
 
-	// update available packages
+	// update available packages and record the result of the task at once
 	if err := ctx.AvailablePackages.Update(&AvailablePackage{
 		Name: taskConfig.GetName(),
 		Version: taskConfig.GetVersion(),
@@ -234,122 +540,115 @@ func (ctx *SubakoContext) Build(
 
 		DepName: taskConfig.GetDepName(),
 		DepVersion: taskConfig.GetDepVersion(),
+		DepKey: taskConfig.GetDeps().Key(),
+
+		ConfigFingerprint: taskConfig.GetFingerprint(),
+		SourceCommit: task.SourceCommit,
+	}, func(tx *gorm.DB) error {
+		task.Status = TaskSucceeded
+		if err := saveTaskRecord(tx, task); err != nil {
+			task.Status = TaskRunning
+			return err
+		}
+		return nil
 	}); err != nil {
+		ctx.reconcile.publishM.Unlock()
 		task.Failed(err.Error())
 		ctx.Logger.Failed(fmt.Sprintf("Failed to update packages: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
 
-		return task
-	}
-
-	// update repository
-	debPath := filepath.Join(ctx.BuilderCtx.packagesDir, result.PkgFileName)
-	if err := ctx.AptRepoCtx.AddPackage(debPath); err != nil {
-		task.Failed(err.Error())
-
-		ctx.Logger.Failed(fmt.Sprintf("Failed to update repo: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
-
-		return task
+		return
 	}
+	ctx.reconcile.publishM.Unlock()
 
 	// TODO: fix...
 	// remove a source deb file to save free storage
 	if err := os.Remove(debPath); err != nil {
-		task.Failed("failed to remove source deb")
+		task.Warning("failed to remove source deb")
 
 		ctx.Logger.Failed(fmt.Sprintf("Failed to remove deb: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
 
-		return task
+		return
 	}
 
 	// notify
-	if ctx.NotificationCtx != nil {
-		if err := ctx.NotificationCtx.PostUpdate(map[string]string{
-			"type": "package_update",
-			"name": string(taskConfig.GetName()),
-			"version": string(taskConfig.GetVersion()),
-			"display_version": result.DisplayVersion,
-			"unix_time": fmt.Sprintf("%v", time.Now().Unix()),
-		}); err != nil {
-			task.Warning(err.Error())
-
-			ctx.Logger.Failed(fmt.Sprintf("Failed to notification: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
-
-			return task
-		}
+	if err := ctx.notify(map[string]string{
+		"type": "package_update",
+		"name": string(taskConfig.GetName()),
+		"version": string(taskConfig.GetVersion()),
+		"display_version": result.DisplayVersion,
+		"unix_time": fmt.Sprintf("%v", time.Now().Unix()),
+	}); err != nil {
+		task.Warning(err.Error())
+
+		ctx.Logger.Failed(fmt.Sprintf("Failed to notification: %s / %s", taskConfig.GetName(), taskConfig.GetVersion()), task.ErrorText)
+
+		return
 	}
 
 	// update profiles
 	if err := ctx.UpdateProfilesWithNotification(); err != nil {
 		task.Warning(err.Error())
 
-		return task
+		return
 	}
-	task.Status = TaskSucceeded
-
 	ctx.Logger.Succeeded(fmt.Sprintf("Build: %s / %s [%v]", taskConfig.GetName(), taskConfig.GetVersion(), result.duration))
 
-	// queue dependency
+	// queue dependency (new tasks use the current config sets)
+	snapshot := ctx.ProcConfigSetsCtx.Snapshot()
 	refs := taskConfig.GetRepDeps()
-	if refs != nil {
-		for _, refName := range refs {
-			if buildConfigSet, ok := ctx.ProcConfigSetsCtx.Map[refName]; ok {
-				for refVersion, _ := range buildConfigSet.Configs {
-					procConfig, err := ctx.ProcConfigSetsCtx.FindWithDep(
-						string(refName),
-						string(refVersion),
-						string(taskConfig.GetName()),
-						string(taskConfig.GetVersion()),
-						ctx.AvailablePackages,
-					)
-					if err != nil {
-						log.Printf("DEP: skip (%s, %s) with (%s, %s) / %s", refName, refVersion, taskConfig.GetName(), taskConfig.GetVersion(), err.Error())
-						continue
-					}
-
-					//
-					pkgBuildCS := ctx.ProcConfigSetsCtx.Map[refName]
-					if pkgVers, ok := pkgBuildCS.DepPkgs[taskConfig.GetName()]; ok {
-						found := false
-						for _, ver := range pkgVers {
-							if ver == taskConfig.GetVersion() {
-								found = true
-							}
-						}
-						if !found {
-							log.Printf("DEP: skip (%s, %s) with (%s, %s) / No dep", refName, refVersion, taskConfig.GetName(), taskConfig.GetVersion())
-							continue
-						}
-
-					} else {
-						log.Printf("DEP: skip (%s, %s) with (%s, %s) / No dep", refName, refVersion, taskConfig.GetName(), taskConfig.GetVersion())
-						continue
-					}
-
-					//
-					log.Printf("DEP: trigger -> (%s, %s) with (%s, %s)", refName, refVersion, taskConfig.GetName(), taskConfig.GetVersion())
-
-					ctx.Queue(procConfig)
+	for _, refName := range refs {
+		buildConfigSet, ok := snapshot.Map[refName]
+		if !ok {
+			continue
+		}
+
+		for refVersion, _ := range buildConfigSet.Configs {
+			for _, deps := range buildConfigSet.DepTuples() {
+				if !deps.Contains(taskConfig.GetName(), taskConfig.GetVersion()) {
+					continue
+				}
+
+				// other packages in the tuple must have been built
+				procConfig, err := snapshot.FindWithDeps(string(refName), string(refVersion), deps, ctx.AvailablePackages)
+				if err != nil {
+					log.Printf("DEP: skip (%s, %s) with (%s) / %s", refName, refVersion, deps.Key(), err.Error())
+					continue
+				}
+
+				log.Printf("DEP: trigger -> (%s, %s) with (%s)", refName, refVersion, deps.Key())
+
+				if err := ctx.Queue(procConfig); err == nil {
+					ctx.Audit.Record(SystemActor("dependency"), AuditQueue, "package", BuildConfigTargetID(procConfig), nil, nil)
 				}
 			}
 		}
 	}
-
-	return task
 }
 
 
 func (ctx *SubakoContext) Queue(
 	procConfig			IPackageBuildConfig,
 ) error {
+	return ctx.queueTask(QueueTask{
+		Proc: procConfig,
+	})
+}
+
+func (ctx *SubakoContext) queueTask(task QueueTask) error {
 	ctx.m.Lock()
 	defer ctx.m.Unlock()
 
-	task := QueueTask{
-		Proc: procConfig,
+	if ctx.closing {
+		return ErrShuttingDown
 	}
+	procConfig := task.Proc
 
+	ctx.ProcConfigSetsCtx.AcquireSnapshot(procConfig.GetSnapshot())	// released by Build
 	ctx.QueueHelper = append(ctx.QueueHelper, task)
-	ctx.queueCh <- task
+	select {
+	case ctx.queueSignal <- struct{}{}:
+	default:	// the worker has been woken up already
+	}
 
 	ctx.Logger.Succeeded(fmt.Sprintf("Queue the task: %s / %s", procConfig.GetName(), procConfig.GetVersion()))
 
@@ -357,15 +656,209 @@ func (ctx *SubakoContext) Queue(
 }
 
 
-func (ctx *SubakoContext) Save() error {
-	if err := ctx.AvailablePackages.Save(); err != nil {
+// queueChangedPackages queues built packages whose config dir has been changed since they were built.
+// Packages which were built before fingerprints were recorded are not queued.
+func (ctx *SubakoContext) queueChangedPackages() {
+	built := make([]AvailablePackage, 0)
+	ctx.AvailablePackages.Walk(func(_ PackageName, _ PackageVersion, _ string, a *AvailablePackage) error {
+		built = append(built, *a)
+		return nil
+	})
+
+	snapshot := ctx.ProcConfigSetsCtx.Snapshot()
+	for _, a := range built {
+		set, ok := snapshot.Map[a.Name]
+		if !ok || !set.IsAutoRebuildEnabled() {
+			continue
+		}
+		config, ok := set.Configs[a.Version]
+		if !ok || a.ConfigFingerprint == "" || a.ConfigFingerprint == config.GetFingerprint() {
+			continue
+		}
+
+		procConfig, err := snapshot.FindBuildConfig(string(a.Name), string(a.Version), a.DepKey, ctx.AvailablePackages)
+		if err != nil {
+			log.Printf("AutoRebuild: skip %s / %v", PackageTargetID(string(a.Name), string(a.Version), a.DepKey), err)
+			continue
+		}
+
+		if ctx.IsQueued(procConfig) {
+			continue
+		}
+
+		log.Printf("AutoRebuild: config is changed -> %s", BuildConfigTargetID(procConfig))
+		if err := ctx.Queue(procConfig); err != nil {
+			ctx.Logger.Failed("AutoRebuild", err.Error())
+			continue
+		}
+		ctx.Audit.Record(SystemActor("auto_rebuild"), AuditQueue, "package", BuildConfigTargetID(procConfig), nil, nil)
+	}
+}
+
+// QueueIfSourceChanged queues the task unless the source is the same as the built package.
+// Packages without sources are always queued. false is returned if the task is skipped.
+func (ctx *SubakoContext) QueueIfSourceChanged(
+	procConfig			IPackageBuildConfig,
+) (bool, error) {
+	task := QueueTask{
+		Proc: procConfig,
+	}
+
+	if source := procConfig.GetSource(); source != nil {
+		commit, err := source.ResolveCommit()
+		if err != nil {
+			// queued anyway as Build does, the source is resolved again when it is built
+			log.Printf("Failed to resolve the source of %s / %v", BuildConfigTargetID(procConfig), err)
+			ctx.Logger.Failed(fmt.Sprintf("Failed to resolve the source: %s / %s", procConfig.GetName(), procConfig.GetVersion()), err.Error())
+		} else {
+			a, err := ctx.AvailablePackages.FindDep(
+				procConfig.GetName(),
+				procConfig.GetVersion(),
+				procConfig.GetDeps().Key(),
+			)
+			if err == nil && a.SourceCommit == commit && a.ConfigFingerprint == procConfig.GetFingerprint() {
+				log.Printf("Source is not changed (%s) -> skip %s", commit, BuildConfigTargetID(procConfig))
+				ctx.Logger.Succeeded(fmt.Sprintf("Skip the task (source is not changed): %s / %s", procConfig.GetName(), procConfig.GetVersion()))
+				return false, nil
+			}
+
+			// the compared commit is built
+			task.SourceCommit = commit
+		}
+	}
+
+	if err := ctx.queueTask(task); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// IsQueued returns true if the same target is waiting in the queue or is being built
+func (ctx *SubakoContext) IsQueued(procConfig IPackageBuildConfig) bool {
+	key := makeQueueTaskKey(procConfig)
+	if task := ctx.RunningTasks.LatestByTarget(key.Name, key.Version, key.depKey()); task != nil && task.IsActive() {
+		return true
+	}
+
+	return ctx.isQueuedTarget(key)
+}
+
+func (ctx *SubakoContext) isQueuedTarget(key QueueTaskKey) bool {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	for _, q := range ctx.QueueHelper {
+		if makeQueueTaskKey(q.Proc) == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ctx *SubakoContext) QueueLength() int {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	return len(ctx.QueueHelper)
+}
+
+
+// notify sends the message if the notification is enabled
+func (ctx *SubakoContext) notify(message interface{}) error {
+	if ctx.NotificationCtx == nil {
+		return nil
+	}
+
+	if err := ctx.NotificationCtx.PostUpdate(message); err != nil {
+		ctx.Metrics.NotificationFailures.Inc()
 		return err
 	}
 
+	return nil
+}
+
+
+func (ctx *SubakoContext) isClosing() bool {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	return ctx.closing
+}
+
+// startBuilding counts a build which Shutdown waits for. It must be called before the build goroutine starts,
+// and it returns false if Subako is closing. The build calls ctx.building.Done() when it finishes.
+func (ctx *SubakoContext) startBuilding() bool {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.closing {
+		return false
+	}
+	ctx.building.Add(1)
+
+	return true
+}
+
+// StopAccepting makes Subako reject new tasks. Queued tasks are kept.
+func (ctx *SubakoContext) StopAccepting() {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.closing {
+		return
+	}
+	log.Println("Stop accepting new tasks")
+
+	ctx.closing = true
+	if ctx.cron != nil {
+		ctx.cron.Stop()
+	}
+	if ctx.configWatcher != nil {
+		ctx.configWatcher.Close()
+	}
+}
+
+// Shutdown stops Subako. It waits for running builds until the deadline (if wait > 0),
+// then interrupts remaining builds and saves all states.
+// Containers of interrupted tasks are left running and reattached at the next start, queued tasks are re-queued.
+func (ctx *SubakoContext) Shutdown(wait time.Duration) error {
+	ctx.StopAccepting()
+
+	if wait > 0 {
+		log.Printf("Waiting for running builds (%v)", wait)
+
+		done := make(chan struct{})
+		go func() {
+			ctx.building.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			log.Println("All builds have finished")
+		case <-time.After(wait):
+			log.Println("Timeout: running builds will be interrupted")
+		}
+	}
+
+	ctx.RunningTasks.InterruptAll()
+	ctx.Logger.Succeeded("Shutdown")
+
+	return ctx.Save()
+}
+
+
+func (ctx *SubakoContext) Save() error {
 	if err := ctx.RunningTasks.Save(); err != nil {
 		return err
 	}
 
+	if err := ctx.saveQueue(); err != nil {
+		return err
+	}
+
 	if err := ctx.Profiles.Save(); err != nil {
 		return err
 	}
@@ -374,16 +867,59 @@ func (ctx *SubakoContext) Save() error {
 }
 
 
+// persist saves the state immediately. Failures are only logged not to stop builds.
+func (ctx *SubakoContext) persist(name string, save func() error) {
+	if err := save(); err != nil {
+		ctx.Logger.Failed(fmt.Sprintf("Failed to save %s", name), err.Error())
+	}
+}
+
+// running on goroutine
+func (ctx *SubakoContext) autosave(interval time.Duration) {
+	for range time.Tick(interval) {
+		if ctx.isClosing() {
+			return	// saved by Shutdown
+		}
+		ctx.persist("states", ctx.Save)
+	}
+}
+
+
+func (ctx *SubakoContext) saveQueue() error {
+	ctx.m.Lock()
+	keys := make([]QueueTaskKey, len(ctx.QueueHelper))
+	for i, q := range ctx.QueueHelper {
+		keys[i] = makeQueueTaskKey(q.Proc)
+	}
+	ctx.m.Unlock()
+
+	ctx.pendingQueue.Tasks = keys
+
+	return ctx.pendingQueue.Save()
+}
+
+
 // running on goroutine
 func (ctx *SubakoContext) execQueuedTask() {
-	for q := range ctx.queueCh {
-		ctx.m.Lock()
-		if len(ctx.QueueHelper) > 0 {
+	for range ctx.queueSignal {
+		for {
+			ctx.m.Lock()
+			if ctx.closing {
+				// leave tasks in the queue to save them
+				ctx.m.Unlock()
+				return
+			}
+			if len(ctx.QueueHelper) == 0 {
+				ctx.m.Unlock()
+				break
+			}
+			q := ctx.QueueHelper[0]
 			ctx.QueueHelper = ctx.QueueHelper[1:]
-		}
-		ctx.m.Unlock()
+			ctx.building.Add(1)		// under the lock, so that Shutdown does not miss it
+			ctx.m.Unlock()
 
-		ctx.Build(q.Proc, nil)
+			ctx.Build(q.Proc, q.SourceCommit, nil)
+		}
 	}
 }
 
@@ -403,13 +939,18 @@ func (ctx *SubakoContext) queueDailyTask() {
 		}
 
 		log.Printf("QueueDailyTask queue :: name: %s / version: %s", task.ProcName, task.Version)
-		if err := ctx.Queue(proc); err != nil {
-			msg := "Failed to queue the task"
+		queued, err := ctx.QueueIfSourceChanged(proc)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to queue the task / %v", err)
 			log.Println(msg)
 			ctx.Logger.Failed("DailyTask", msg)
 
 			continue
 		}
+		if !queued {
+			continue
+		}
+		ctx.Audit.Record(SystemActor("daily_tasks"), AuditQueue, "package", BuildConfigTargetID(proc), nil, nil)
 	}
 
 	ctx.Logger.Succeeded("QueueDailyTask finished")
@@ -419,11 +960,12 @@ func (ctx *SubakoContext) queueDailyTask() {
 func (ctx *SubakoContext) UpdateProfiles() error {
 	if err := ctx.Profiles.GenerateProcProfiles(
 		ctx.AvailablePackages,
-		ctx.ProcConfigSetsCtx.Map,
+		ctx.ProcConfigSetsCtx.Snapshot().Map,
 	); err != nil {
 		ctx.Logger.Failed("UpdateProfiles", err.Error())
 		return err
 	}
+	ctx.persist("Profiles", ctx.Profiles.Save)
 
 	ctx.Logger.Succeeded("UpdateProfiles")
 	return nil
@@ -435,13 +977,11 @@ func (ctx *SubakoContext) UpdateProfilesWithNotification() error {
 		return err
 	}
 
-	if ctx.NotificationCtx != nil {
-		if err := ctx.NotificationCtx.PostUpdate(map[string]string{
-			"type": "profile_update",
-		}); err != nil {
-			ctx.Logger.Failed("UpdateProfilesWithNotification", err.Error())
-			return err
-		}
+	if err := ctx.notify(map[string]string{
+		"type": "profile_update",
+	}); err != nil {
+		ctx.Logger.Failed("UpdateProfilesWithNotification", err.Error())
+		return err
 	}
 
 	ctx.Logger.Succeeded("UpdateProfilesWithNotification")
@@ -454,6 +994,7 @@ func (ctx *SubakoContext) RefreshProfileConfigs() error {
 		ctx.Logger.Failed("RefreshProfileConfigs", err.Error())
 		return err
 	}
+	ctx.queueChangedPackages()
 
 	if err := ctx.UpdateProfilesWithNotification(); err != nil {
 		return err
@@ -463,38 +1004,18 @@ func (ctx *SubakoContext) RefreshProfileConfigs() error {
 	return nil
 }
 
-
-func (ctx *SubakoContext) RemovePackage(name, version string) error {
-	return ctx.RemovePackageDep(name, version, "", "")
-}
-
-
-func (ctx *SubakoContext) RemovePackageDep(name, version, depName, depVersion string) error {
-	pkg, err := ctx.AvailablePackages.FindDep(
-		PackageName(name),
-		PackageVersion(version),
-		PackageName(depName),
-		PackageVersion(depVersion),
-	)
-	if err != nil {
-		ctx.Logger.Failed("RemovePackage", err.Error())
-		return err
-	}
-
-	// remove from apt repository
-	pkgName := pkg.GeneratedPackageName
-	if err := ctx.AptRepoCtx.RemovePackage(pkgName); err != nil {
-		ctx.Logger.Failed("RemovePackage", fmt.Sprintf("Failed to remove from repo: %s / %s", pkgName, err.Error()))
+// SwitchConfigSetsRef checks out the ref of remote config sets and regenerates profiles
+func (ctx *SubakoContext) SwitchConfigSetsRef(ref string) error {
+	if err := ctx.ProcConfigSetsCtx.SetRef(ref); err != nil {
+		ctx.Logger.Failed("SwitchConfigSetsRef", err.Error())
 		return err
 	}
+	ctx.queueChangedPackages()
 
-	//
-	if err := ctx.AvailablePackages.Remove(name, version, depName, depVersion); err != nil {
-		ctx.Logger.Failed("RemovePackage", err.Error())
+	if err := ctx.UpdateProfilesWithNotification(); err != nil {
 		return err
 	}
 
-	ctx.Logger.Succeeded(fmt.Sprintf("RemovePackage: %s / %s", name, version))
-
-	return ctx.UpdateProfilesWithNotification()
+	ctx.Logger.Succeeded("SwitchConfigSetsRef")
+	return nil
 }
@@ -0,0 +1,139 @@
+package subako
+
+import (
+	"os"
+	"errors"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+
+// UserConfig is the content of config.yml
+type UserConfig struct {
+	Server			struct {
+		Port		int
+	}
+	Notification	struct {
+		Url			string
+		Secret		string
+	}
+	Cron			struct {
+		Hour		int
+		Minute		int
+	}
+	Auth			struct {
+		User		string
+		Password	string
+	}
+	Builder			*struct {
+		PackagePrefix		string	`yaml:"package_prefix"`
+		InstallBasePrefix	string	`yaml:"install_base_prefix"`
+	}
+	Shutdown		struct {
+		WaitRunningBuildsSec	int		`yaml:"wait_running_builds_sec"`
+	}
+	Health			struct {
+		MinFreeDiskMB	uint64	`yaml:"min_free_disk_mb"`
+	}
+	Storage			struct {
+		AutosaveIntervalSec		int		`yaml:"autosave_interval_sec"`
+		OrphanCheckIntervalSec	int		`yaml:"orphan_check_interval_sec"`
+	}
+	ConfigSets		struct {
+		Remote		bool
+		Path		string
+		Repository	string
+		Ref			string
+		RepoSecret	string	`yaml:"webhook_secret"`
+		Watch		bool
+		WatchDebounceMs	int	`yaml:"watch_debounce_ms"`
+	} `yaml:"config_sets"`
+}
+
+func LoadUserConfig(path string) (*UserConfig, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var uConfig UserConfig
+	if err := yaml.Unmarshal(buffer, &uConfig); err != nil {
+		return nil, err
+	}
+
+	if uConfig.Builder == nil {
+		return nil, errors.New("builder section is not written in config")
+	}
+
+	return &uConfig, nil
+}
+
+// StorageDir returns the directory which holds all states of Subako
+func StorageDir(cwd string) string {
+	return path.Join(cwd, "_storage")
+}
+
+// ConfigSetsDir returns the absolute path of config sets
+func (uConfig *UserConfig) ConfigSetsDir(cwd string) string {
+	if filepath.IsAbs(uConfig.ConfigSets.Path) {
+		return uConfig.ConfigSets.Path
+	} else {
+		return path.Join(cwd, uConfig.ConfigSets.Path)
+	}
+}
+
+// MakeSubakoConfig makes the config for MakeSubakoContext. The storage dir is created if it does not exist.
+func (uConfig *UserConfig) MakeSubakoConfig(cwd string) (*SubakoConfig, error) {
+	// make storage dir
+	storageDir := StorageDir(cwd)
+	if !Exists(storageDir) {
+		if err := os.Mkdir(storageDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SubakoConfig{
+		ProcConfigSetsConf: &ProcConfigSetsConfig{
+			IsRemote: uConfig.ConfigSets.Remote,
+			BaseDir: uConfig.ConfigSetsDir(cwd),
+			Repository: uConfig.ConfigSets.Repository,
+			Ref: uConfig.ConfigSets.Ref,
+			RefStatePath: path.Join(storageDir, "config_sets_ref.json"),
+			SnapshotsDir: path.Join(storageDir, "config_snapshots"),
+		},
+		AvailablePackagesPath: path.Join(storageDir, "available_packages.json"),
+		AptRepositoryBaseDir: path.Join(storageDir, "apt_repository"),
+
+		VirtualUsrDir: path.Join(storageDir, "torigoya_usr"),
+		TmpBaseDir: path.Join(storageDir, "temp"),
+		PackagesDir: path.Join(storageDir, "packages"),
+		PackagePrefix: uConfig.Builder.PackagePrefix,
+		InstallBasePrefix: uConfig.Builder.InstallBasePrefix,
+
+		RunningTasksPath: path.Join(storageDir, "running_tasks.json"),
+		QueuedTasksPath: path.Join(storageDir, "queued_tasks.json"),
+		ProfilesHolderPath: path.Join(storageDir, "proc_profiles.json"),
+		DataBasePath: path.Join(storageDir, "db.sqlite"),
+		NotificationConf: &NotificationConfig{
+			TargetUrl: uConfig.Notification.Url,
+			Secret: uConfig.Notification.Secret,
+		},
+		CronData: Crontab {
+			Hour: uConfig.Cron.Hour,
+			Minute: uConfig.Cron.Minute,
+		},
+		LogDir: "/tmp",
+
+		StorageDir: storageDir,
+		MinFreeDiskBytes: uConfig.Health.MinFreeDiskMB * 1024 * 1024,
+		AutosaveInterval: time.Duration(uConfig.Storage.AutosaveIntervalSec) * time.Second,
+		OrphanCheckInterval: time.Duration(uConfig.Storage.OrphanCheckIntervalSec) * time.Second,
+
+		WatchConfigSets: uConfig.ConfigSets.Watch,
+		ConfigWatchDebounce: time.Duration(uConfig.ConfigSets.WatchDebounceMs) * time.Millisecond,
+	}, nil
+}
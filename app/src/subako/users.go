@@ -0,0 +1,241 @@
+package subako
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+
+type UserRole int
+const (
+	RoleNone = UserRole(0)		// anonymous
+	RoleViewer = UserRole(1)
+	RoleBuilder = UserRole(2)	// can queue/build/abort
+	RoleAdmin = UserRole(3)		// can remove packages, edit webhooks/daily tasks, reload configs
+)
+
+func (r UserRole) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleBuilder:
+		return "builder"
+	case RoleAdmin:
+		return "admin"
+	}
+	return ""
+}
+
+func ParseUserRole(s string) (UserRole, error) {
+	switch s {
+	case "viewer":
+		return RoleViewer, nil
+	case "builder":
+		return RoleBuilder, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RoleNone, fmt.Errorf("Unknown role: %s", s)
+}
+
+
+type User struct {
+	gorm.Model
+	Name			string		`sql:"unique"`
+	PasswordHash	string
+	Role			UserRole
+
+	AuthToken		string		`sql:"-"`	// name of the token when authenticated by an API token
+}
+
+func (u *User) HasRole(role UserRole) bool {
+	return u != nil && u.Role >= role
+}
+
+// ActorName returns the name which is recorded to the audit log
+func (u *User) ActorName() string {
+	if u.AuthToken != "" && u.ID != 0 {
+		// personal token
+		return u.Name + " (token:" + u.AuthToken + ")"
+	}
+
+	return u.Name
+}
+
+func (u *User) AuditValue() map[string]string {
+	return map[string]string{
+		"name": u.Name,
+		"role": u.Role.String(),
+	}
+}
+
+func (u *User) CanBuild() bool {
+	return u.HasRole(RoleBuilder)
+}
+
+func (u *User) CanAdmin() bool {
+	return u.HasRole(RoleAdmin)
+}
+
+
+var ErrAuthenticationFailed = errors.New("invalid user name or password")
+var ErrLastAdmin = errors.New("at least one admin must be left")
+
+type UsersContext struct {
+	Db		gorm.DB
+	m		sync.Mutex		// serializes changes of roles, so that the last admin is not removed
+}
+
+func MakeUsersContext(db gorm.DB) (*UsersContext, error) {
+	db.AutoMigrate(&User{})
+
+	// users were soft deleted before, and their names could not be used again
+	if err := db.Debug().Unscoped().Where("deleted_at IS NOT NULL").Delete(&User{}).Error; err != nil {
+		return nil, err
+	}
+
+	return &UsersContext{
+		Db: db,
+	}, nil
+}
+
+func (ctx *UsersContext) GetUsers() []User {
+	users := []User{}
+	ctx.Db.Debug().Order("name").Find(&users)
+
+	return users
+}
+
+func (ctx *UsersContext) Count() int {
+	count := 0
+	ctx.Db.Debug().Model(&User{}).Count(&count)
+
+	return count
+}
+
+func (ctx *UsersContext) countAdmins() int {
+	count := 0
+	ctx.Db.Debug().Model(&User{}).Where("role >= ?", RoleAdmin).Count(&count)
+
+	return count
+}
+
+func (ctx *UsersContext) Get(id uint) (*User, error) {
+	user := User{}
+	if err := ctx.Db.Debug().First(&user, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (ctx *UsersContext) GetByName(name string) (*User, error) {
+	user := User{}
+	if err := ctx.Db.Debug().Where(&User{Name: name}).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (ctx *UsersContext) Append(name, password string, role UserRole) (*User, error) {
+	if name == "" {
+		return nil, errors.New("name is empty")
+	}
+	if password == "" {
+		return nil, errors.New("password is empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Name: name,
+		PasswordHash: string(hash),
+		Role: role,
+	}
+	if err := ctx.Db.Debug().Create(user).Error; err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Update changes the name and the role of the user.
+// The password is kept when the given password is empty.
+func (ctx *UsersContext) Update(id uint, name, password string, role UserRole) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	user, err := ctx.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if user.HasRole(RoleAdmin) && role < RoleAdmin && ctx.countAdmins() <= 1 {
+		return ErrLastAdmin
+	}
+	user.Name = name
+	user.Role = role
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = string(hash)
+	}
+
+	return ctx.Db.Debug().Save(user).Error
+}
+
+func (ctx *UsersContext) Delete(id uint) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	user, err := ctx.Get(id)
+	if err != nil {
+		return err
+	}
+	if user.HasRole(RoleAdmin) && ctx.countAdmins() <= 1 {
+		return ErrLastAdmin
+	}
+
+	// hard delete, so that the name can be used again
+	return ctx.Db.Debug().Unscoped().Delete(user).Error
+}
+
+func (ctx *UsersContext) Authenticate(name, password string) (*User, error) {
+	user, err := ctx.GetByName(name)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return user, nil
+}
+
+// EnsureAdmin creates the initial admin account when there are no users.
+func (ctx *UsersContext) EnsureAdmin(name, password string) error {
+	if ctx.Count() > 0 {
+		return nil
+	}
+
+	if _, err := ctx.Append(name, password, RoleAdmin); err != nil {
+		return fmt.Errorf("Failed to create the initial admin: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package subako
+
+import (
+	"sort"
+	"strings"
+)
+
+
+// moving versions always point to the newest sources, so they are newer than any releases
+var movingVersions = map[string]int{
+	"head": 2,
+	"nightly": 2,
+	"trunk": 2,
+	"master": 2,
+	"main": 2,
+	"latest": 2,
+	"dev": 1,
+	"snapshot": 1,
+}
+
+// pre-release tags are older than the release which has the same numbers (Ex. 1.0-rc1 < 1.0)
+var preReleaseTags = map[string]int{
+	"dev": 0,
+	"alpha": 1,
+	"beta": 2,
+	"pre": 3,
+	"preview": 3,
+	"rc": 4,
+}
+
+// CompareVersions returns -1 if a is older than b, 1 if a is newer than b, otherwise 0.
+// Numeric parts are compared as numbers (Ex. 9.0 < 10.0), pre-release tags are older than releases,
+// and moving versions such as HEAD or nightly are the newest.
+func CompareVersions(a, b string) int {
+	ma, aIsMoving := movingVersionRank(a)
+	mb, bIsMoving := movingVersionRank(b)
+	switch {
+	case aIsMoving && bIsMoving:
+		if ma != mb {
+			return compareInts(ma, mb)
+		}
+		return compareStrings(a, b)
+	case aIsMoving:
+		return 1
+	case bIsMoving:
+		return -1
+	}
+
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; ; i++ {
+		switch {
+		case i >= len(ta) && i >= len(tb):
+			return compareStrings(a, b)		// same numbers, Ex. "1.0" and "1-0"
+		case i >= len(ta):
+			if isPreReleaseTag(tb[i]) {
+				return 1
+			}
+			return -1
+		case i >= len(tb):
+			if isPreReleaseTag(ta[i]) {
+				return -1
+			}
+			return 1
+		}
+
+		if c := compareVersionTokens(ta[i], tb[i]); c != 0 {
+			return c
+		}
+	}
+}
+
+func movingVersionRank(v string) (int, bool) {
+	tokens := versionTokens(v)
+	if len(tokens) == 0 {
+		return 0, false
+	}
+
+	rank, ok := movingVersions[tokens[0]]
+	return rank, ok
+}
+
+// versionTokens splits the version into lower-cased numeric and alphabetic parts
+func versionTokens(v string) []string {
+	tokens := make([]string, 0)
+	current := ""
+	currentIsDigit := false
+	for _, r := range strings.ToLower(v) {
+		isDigit := '0' <= r && r <= '9'
+		isAlpha := 'a' <= r && r <= 'z'
+		if !isDigit && !isAlpha {
+			if current != "" {
+				tokens = append(tokens, current)
+				current = ""
+			}
+			continue
+		}
+
+		if current != "" && isDigit != currentIsDigit {
+			tokens = append(tokens, current)
+			current = ""
+		}
+		current += string(r)
+		currentIsDigit = isDigit
+	}
+	if current != "" {
+		tokens = append(tokens, current)
+	}
+
+	return tokens
+}
+
+func isNumericToken(t string) bool {
+	return t != "" && '0' <= t[0] && t[0] <= '9'
+}
+
+func isPreReleaseTag(t string) bool {
+	_, ok := preReleaseTags[t]
+	return ok
+}
+
+func compareVersionTokens(a, b string) int {
+	aIsNum, bIsNum := isNumericToken(a), isNumericToken(b)
+	switch {
+	case aIsNum && bIsNum:
+		// compare as numbers without overflow
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			return compareInts(len(a), len(b))
+		}
+		return compareStrings(a, b)
+	case aIsNum:
+		return 1		// Ex. 1.0.1 > 1.0.rc1, 1.0.1 > 1.0.x
+	case bIsNum:
+		return -1
+	}
+
+	pa, aIsPre := preReleaseTags[a]
+	pb, bIsPre := preReleaseTags[b]
+	switch {
+	case aIsPre && bIsPre:
+		return compareInts(pa, pb)
+	case aIsPre:
+		return -1
+	case bIsPre:
+		return 1
+	}
+
+	return compareStrings(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+
+// versionsDesc sorts versions from the newest
+type versionsDesc []string
+
+func (v versionsDesc) Len() int { return len(v) }
+func (v versionsDesc) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v versionsDesc) Less(i, j int) bool { return CompareVersions(v[i], v[j]) > 0 }
+
+// SortVersions sorts versions from the newest
+func SortVersions(versions []string) {
+	sort.Stable(versionsDesc(versions))
+}
+
+// LatestVersion returns the newest version (empty if versions is empty)
+func LatestVersion(versions []string) string {
+	latest := ""
+	for i, v := range versions {
+		if i == 0 || CompareVersions(v, latest) > 0 {
+			latest = v
+		}
+	}
+
+	return latest
+}
@@ -0,0 +1,152 @@
+package subako
+
+import (
+	"sort"
+	"strings"
+	"path/filepath"
+)
+
+
+// An alias is resolved to a built version. The target is a concrete version or a selector.
+const (
+	AliasSelectorLatest = "@latest"		// the newest version including HEAD and pre-releases
+	AliasSelectorRelease = "@release"	// the newest version except moving versions and pre-releases
+)
+
+// VersionAliases maps alias names (Ex. latest, stable) to targets
+type VersionAliases map[string]string
+
+// checkAliases appends problems of aliases in the config to errs
+func checkAliases(aliases VersionAliases, versions []string, configPath string, errs *ConfigErrors) {
+	known := make(map[string]bool)
+	for _, v := range versions {
+		known[v] = true
+	}
+
+	for _, alias := range sortedAliasNames(aliases) {
+		target := aliases[alias]
+		field := "aliases." + alias
+
+		if reason := checkConfigVersion(alias); reason != "" {
+			errs.add(configPath, field, "%s", reason)
+			continue
+		}
+		if known[alias] {
+			errs.add(configPath, field, "%q is also a version", alias)
+			continue
+		}
+
+		switch {
+		case target == AliasSelectorLatest || target == AliasSelectorRelease:
+		case strings.HasPrefix(target, "@"):
+			errs.add(configPath, field, "unknown selector %q (%s or %s)", target, AliasSelectorLatest, AliasSelectorRelease)
+		case !known[target]:
+			errs.add(configPath, field, "%q is not in versions", target)
+		}
+	}
+}
+
+// resolveAlias returns the version which the target points in available versions
+func resolveAlias(target string, available []string) (string, bool) {
+	switch target {
+	case AliasSelectorLatest:
+		if len(available) == 0 {
+			return "", false
+		}
+		return LatestVersion(available), true
+
+	case AliasSelectorRelease:
+		releases := make([]string, 0)
+		for _, v := range available {
+			if isReleaseVersion(v) {
+				releases = append(releases, v)
+			}
+		}
+		if len(releases) == 0 {
+			return "", false
+		}
+		return LatestVersion(releases), true
+	}
+
+	for _, v := range available {
+		if v == target {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// isReleaseVersion returns false for moving versions and pre-releases
+func isReleaseVersion(v string) bool {
+	if _, ok := movingVersionRank(v); ok {
+		return false
+	}
+	for _, t := range versionTokens(v) {
+		if isPreReleaseTag(t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedAliasNames(aliases VersionAliases) []string {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// collectLangAliases merges aliases for each language in the order of package names
+// (aliases of packages are applied to all languages in them). If packages declare the same alias of a language
+// with different targets, the first one is kept and the conflict is appended to errs (can be nil).
+func collectLangAliases(pc ProcConfigMap, errs *ConfigErrors) map[LanguageName]VersionAliases {
+	type origin struct {
+		target		string
+		pkgName		PackageName
+	}
+
+	langAliases := make(map[LanguageName]VersionAliases)
+	origins := make(map[LanguageName]map[string]origin)
+	for _, name := range sortedPackageNames(pc) {
+		set := pc[name]
+		for _, lc := range set.SortedLangConfigs() {
+			if _, ok := langAliases[lc.Name]; !ok {
+				langAliases[lc.Name] = make(VersionAliases)
+				origins[lc.Name] = make(map[string]origin)
+			}
+
+			aliases := mergeAliases(set.Aliases, lc.Aliases)
+			for _, alias := range sortedAliasNames(aliases) {
+				target := aliases[alias]
+				if prev, ok := origins[lc.Name][alias]; ok {
+					if prev.target != target && errs != nil {
+						errs.add(filepath.Join(lc.basePath, "config.json"), "aliases." + alias, "conflicts with %q of package %s for language %s", prev.target, prev.pkgName, lc.Name)
+					}
+					continue
+				}
+				origins[lc.Name][alias] = origin{target: target, pkgName: set.Name}
+				langAliases[lc.Name][alias] = target
+			}
+		}
+	}
+
+	return langAliases
+}
+
+// mergeAliases returns aliases of both. Aliases of over take precedence.
+func mergeAliases(base, over VersionAliases) VersionAliases {
+	merged := make(VersionAliases)
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range over {
+		merged[k] = v
+	}
+
+	return merged
+}
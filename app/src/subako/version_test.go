@@ -0,0 +1,85 @@
+package subako
+
+import (
+	"testing"
+)
+
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b		string
+		expected	int
+	}{
+		{"9.0", "10.0", -1},
+		{"10.0", "9.0", 1},
+		{"1.2.3", "1.2.3", 0},
+		{"1.10", "1.9", 1},
+		{"1.0", "1.0.1", -1},
+		{"1.0", "1.0.0", -1},
+		{"010", "10", -1},		// same numbers are ordered by strings to be total
+
+		// pre-releases are older than the release
+		{"1.0-rc1", "1.0", -1},
+		{"1.0", "1.0rc1", 1},
+		{"1.0-alpha", "1.0-beta", -1},
+		{"1.0-beta2", "1.0-rc1", -1},
+		{"1.0-rc1", "1.0-rc2", -1},
+		{"1.0.1", "1.0.rc1", 1},
+		{"1.0-rc1", "0.9", 1},
+
+		// moving versions are the newest
+		{"HEAD", "10.0", 1},
+		{"10.0", "head", -1},
+		{"nightly", "99999", 1},
+		{"dev", "1.0", 1},
+		{"HEAD", "dev", 1},
+	}
+
+	for _, c := range cases {
+		if actual := CompareVersions(c.a, c.b); actual != c.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", c.a, c.b, actual, c.expected)
+		}
+		if actual := CompareVersions(c.b, c.a); actual != -c.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", c.b, c.a, actual, -c.expected)
+		}
+	}
+}
+
+func TestCompareVersionsIsTransitive(t *testing.T) {
+	versions := []string{
+		"1", "1.0", "1-0", "1.0.0", "1.0.1", "1.0-rc1", "1.0rc2", "1.0-alpha", "1.0-beta", "1.0.x",
+		"2", "9.0", "10.0", "10.0-rc1", "0.9", "HEAD", "head", "nightly", "dev", "snapshot", "latest",
+		"5.2.0", "6.1.0", "3.8", "3.9", "2016.05",
+	}
+
+	for _, a := range versions {
+		if c := CompareVersions(a, a); c != 0 {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected 0", a, a, c)
+		}
+
+		for _, b := range versions {
+			ab := CompareVersions(a, b)
+			if ab != -CompareVersions(b, a) {
+				t.Errorf("CompareVersions(%q, %q) is not antisymmetric", a, b)
+			}
+
+			for _, c := range versions {
+				if ab < 0 && CompareVersions(b, c) < 0 && CompareVersions(a, c) >= 0 {
+					t.Errorf("%q < %q < %q, but CompareVersions(%q, %q) = %d", a, b, c, a, c, CompareVersions(a, c))
+				}
+			}
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []string{"9.0", "HEAD", "10.0-rc1", "10.0", "1.0"}
+	SortVersions(versions)
+
+	expected := []string{"HEAD", "10.0", "10.0-rc1", "9.0", "1.0"}
+	for i := range expected {
+		if versions[i] != expected[i] {
+			t.Fatalf("SortVersions = %v, expected %v", versions, expected)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package subako
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+
     "github.com/jinzhu/gorm"
 )
 
@@ -12,6 +15,22 @@ type Webhook struct {
 	Version		string
 }
 
+// AuditValue returns values for the audit log. The secret is replaced with its fingerprint.
+func (h *Webhook) AuditValue() map[string]string {
+	secret := ""
+	if h.Secret != "" {
+		sum := sha256.Sum256([]byte(h.Secret))
+		secret = "sha256:" + hex.EncodeToString(sum[:])[:8]
+	}
+
+	return map[string]string{
+		"target": h.Target,
+		"secret": secret,
+		"proc_name": h.ProcName,
+		"version": h.Version,
+	}
+}
+
 type WebhookContext struct {
 	Db		gorm.DB
 }
@@ -56,6 +75,15 @@ func (ctx *WebhookContext) Delete(id uint) error {
 	return nil
 }
 
+func (ctx *WebhookContext) Get(id uint) (*Webhook, error) {
+	hook := Webhook{}
+	if err := ctx.Db.Debug().First(&hook, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
 func (ctx *WebhookContext) GetByTarget(target string) (*Webhook, error) {
 	// TODO: error handling
 	hook := Webhook{}